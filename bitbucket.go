@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// newBitbucketCloudClient returns a client for the Bitbucket Cloud REST API at apiURL
+// (e.g. https://api.bitbucket.org/2.0) that authenticates with a repository, project or workspace access token.
+func newBitbucketCloudClient(apiURL, token string) *restClient {
+	return &restClient{
+		url:    apiURL,
+		header: http.Header{"Authorization": {"Bearer " + token}},
+		http:   &http.Client{},
+	}
+}
+
+// bitbucketCloudPullRequest implements commenter for a Bitbucket Cloud pull request.
+type bitbucketCloudPullRequest struct {
+	client *restClient
+	// repo is the full name of the repository (workspace/slug).
+	repo string
+	id   string
+}
+
+func (pr *bitbucketCloudPullRequest) path() string {
+	return "/repositories/" + escapePathSegments(pr.repo) + "/pullrequests/" + url.PathEscape(pr.id)
+}
+
+// bitbucketPipelinesOptions returns options for running in a Bitbucket Pipelines pull request pipeline.
+// See https://support.atlassian.com/bitbucket-cloud/docs/variables-and-secrets/
+func bitbucketPipelinesOptions() (*options, error) {
+	token := os.Getenv("CODENOTIFY_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("env var CODENOTIFY_TOKEN not set")
+	}
+
+	pr := &bitbucketCloudPullRequest{
+		client: newBitbucketCloudClient("https://api.bitbucket.org/2.0", token),
+		repo:   os.Getenv("BITBUCKET_REPO_FULL_NAME"),
+		id:     os.Getenv("BITBUCKET_PR_ID"),
+	}
+
+	info, err := pr.info()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Draft {
+		fmt.Fprintln(verbose, "Not sending notifications for draft pull request.")
+		return nil, nil
+	}
+
+	commitCount, err := pr.commitCount()
+	if err != nil {
+		return nil, err
+	}
+
+	cwd := os.Getenv("BITBUCKET_CLONE_DIR")
+	if err := deepen(cwd, commitCount); err != nil {
+		return nil, err
+	}
+
+	filename, subscriberThreshold := ciSettings()
+	o := &options{
+		cwd:                 cwd,
+		format:              "markdown",
+		filename:            filename,
+		subscriberThreshold: subscriberThreshold,
+		baseRef:             os.Getenv("BITBUCKET_PR_DESTINATION_COMMIT"),
+		headRef:             os.Getenv("BITBUCKET_COMMIT"),
+		author:              "@" + info.Author.Nickname,
+		url:                 info.Links.HTML.Href,
+	}
+	if err := o.applyEnv(ciVariables, false); err != nil {
+		return nil, err
+	}
+	o.print = commentOn(o, pr)
+	if err := addSinksFromEnv(o, ciVariables); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// bitbucketCloudPullRequestInfo is the subset of a pull request's attributes that codenotify uses.
+type bitbucketCloudPullRequestInfo struct {
+	Draft  bool `json:"draft"`
+	Author struct {
+		Nickname string `json:"nickname"`
+	} `json:"author"`
+	Links struct {
+		HTML struct {
+			Href string `json:"href"`
+		} `json:"html"`
+	} `json:"links"`
+}
+
+func (pr *bitbucketCloudPullRequest) info() (*bitbucketCloudPullRequestInfo, error) {
+	info := &bitbucketCloudPullRequestInfo{}
+	_, err := pr.client.do(http.MethodGet, pr.path(), nil, info)
+	return info, err
+}
+
+// commitCount returns the number of commits in the pull request.
+func (pr *bitbucketCloudPullRequest) commitCount() (int, error) {
+	count := 0
+	next := pr.path() + "/commits?pagelen=100"
+	for next != "" {
+		page := struct {
+			Values []struct{} `json:"values"`
+			Next   string     `json:"next"`
+		}{}
+		if _, err := pr.client.do(http.MethodGet, next, nil, &page); err != nil {
+			return 0, err
+		}
+		count += len(page.Values)
+		next = page.Next
+	}
+	return count, nil
+}
+
+// existingComment searches comments newest first, one page at a time.
+func (pr *bitbucketCloudPullRequest) existingComment(marker string) (string, string, error) {
+	next := pr.path() + "/comments?pagelen=100&sort=-created_on"
+	for next != "" {
+		page := struct {
+			Values []struct {
+				ID      int64 `json:"id"`
+				Deleted bool  `json:"deleted"`
+				Content struct {
+					Raw string `json:"raw"`
+				} `json:"content"`
+			} `json:"values"`
+			Next string `json:"next"`
+		}{}
+		if _, err := pr.client.do(http.MethodGet, next, nil, &page); err != nil {
+			return "", "", err
+		}
+
+		for _, comment := range page.Values {
+			if !comment.Deleted && strings.HasPrefix(comment.Content.Raw, marker) {
+				return strconv.FormatInt(comment.ID, 10), comment.Content.Raw, nil
+			}
+		}
+		next = page.Next
+	}
+	return "", "", nil
+}
+
+func (pr *bitbucketCloudPullRequest) addComment(body string) error {
+	fmt.Fprintf(verbose, "adding comment to pull request %s\n", pr.id)
+	_, err := pr.client.do(http.MethodPost, pr.path()+"/comments", bitbucketCloudComment(body), nil)
+	return err
+}
+
+func (pr *bitbucketCloudPullRequest) updateComment(id, body string) error {
+	fmt.Fprintf(verbose, "updating existing comment: %s\n", id)
+	_, err := pr.client.do(http.MethodPut, pr.path()+"/comments/"+url.PathEscape(id), bitbucketCloudComment(body), nil)
+	return err
+}
+
+func (pr *bitbucketCloudPullRequest) deleteComment(id string) error {
+	fmt.Fprintf(verbose, "deleting comment: %s\n", id)
+	_, err := pr.client.do(http.MethodDelete, pr.path()+"/comments/"+url.PathEscape(id), nil, nil)
+	return err
+}
+
+func bitbucketCloudComment(body string) interface{} {
+	return map[string]interface{}{
+		"content": map[string]string{"raw": body},
+	}
+}
+
+// mention uses the @{...} syntax, which accepts a nickname or an account ID.
+func (pr *bitbucketCloudPullRequest) mention(handle string) string {
+	return "@{" + strings.TrimPrefix(handle, "@") + "}"
+}
+
+// newBitbucketServerClient returns a client for the Bitbucket Server (or Data Center) REST API at apiURL
+// (e.g. https://bitbucket.example.com/rest/api/1.0) that authenticates with an HTTP access token.
+func newBitbucketServerClient(apiURL, token string) *restClient {
+	return &restClient{
+		url:    apiURL,
+		header: http.Header{"Authorization": {"Bearer " + token}},
+		http:   &http.Client{},
+	}
+}
+
+// bitbucketServerPullRequest implements commenter for a Bitbucket Server pull request.
+type bitbucketServerPullRequest struct {
+	client *restClient
+	// repo is the project key and repository slug (PROJECT/slug).
+	repo string
+	id   string
+	// versions are the versions of comments that have been found,
+	// which Bitbucket Server requires to update a comment.
+	versions map[string]int
+}
+
+func (pr *bitbucketServerPullRequest) path() string {
+	project, slug := pr.repo, ""
+	if i := strings.Index(pr.repo, "/"); i >= 0 {
+		project, slug = pr.repo[:i], pr.repo[i+1:]
+	}
+	return "/projects/" + url.PathEscape(project) + "/repos/" + url.PathEscape(slug) + "/pull-requests/" + url.PathEscape(pr.id)
+}
+
+// existingComment searches the pull request's activities, which are listed newest first, one page at a time.
+func (pr *bitbucketServerPullRequest) existingComment(marker string) (string, string, error) {
+	start := 0
+	for {
+		page := struct {
+			Values []struct {
+				Action  string `json:"action"`
+				Comment struct {
+					ID      int64  `json:"id"`
+					Text    string `json:"text"`
+					Version int    `json:"version"`
+				} `json:"comment"`
+			} `json:"values"`
+			IsLastPage    bool `json:"isLastPage"`
+			NextPageStart int  `json:"nextPageStart"`
+		}{}
+		path := fmt.Sprintf("%s/activities?limit=100&start=%d", pr.path(), start)
+		if _, err := pr.client.do(http.MethodGet, path, nil, &page); err != nil {
+			return "", "", err
+		}
+
+		for _, activity := range page.Values {
+			if activity.Action == "COMMENTED" && strings.HasPrefix(activity.Comment.Text, marker) {
+				id := strconv.FormatInt(activity.Comment.ID, 10)
+				if pr.versions == nil {
+					pr.versions = map[string]int{}
+				}
+				pr.versions[id] = activity.Comment.Version
+				return id, activity.Comment.Text, nil
+			}
+		}
+
+		if page.IsLastPage {
+			return "", "", nil
+		}
+		start = page.NextPageStart
+	}
+}
+
+func (pr *bitbucketServerPullRequest) addComment(body string) error {
+	fmt.Fprintf(verbose, "adding comment to pull request %s\n", pr.id)
+	_, err := pr.client.do(http.MethodPost, pr.path()+"/comments", map[string]interface{}{"text": body}, nil)
+	return err
+}
+
+func (pr *bitbucketServerPullRequest) updateComment(id, body string) error {
+	fmt.Fprintf(verbose, "updating existing comment: %s\n", id)
+	_, err := pr.client.do(http.MethodPut, pr.path()+"/comments/"+url.PathEscape(id), map[string]interface{}{
+		"text":    body,
+		"version": pr.versions[id],
+	}, nil)
+	return err
+}
+
+func (pr *bitbucketServerPullRequest) deleteComment(id string) error {
+	fmt.Fprintf(verbose, "deleting comment: %s\n", id)
+	_, err := pr.client.do(http.MethodDelete, fmt.Sprintf("%s/comments/%s?version=%d", pr.path(), url.PathEscape(id), pr.versions[id]), nil, nil)
+	return err
+}
+
+// mention quotes the username so that usernames with special characters (e.g. email addresses) work.
+func (pr *bitbucketServerPullRequest) mention(handle string) string {
+	return `@"` + strings.TrimPrefix(handle, "@") + `"`
+}
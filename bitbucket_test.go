@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCommentOnBitbucketCloudPullRequest(t *testing.T) {
+	report := markdownReport("CODENOTIFY", "a", "b")
+
+	runCommentTests(t, []commentTest{
+		{
+			name:      "create",
+			comments:  []string{"lgtm"},
+			notifs:    map[string][]string{"@go": {"file.go"}, "@js:silent": {"file.js"}},
+			requests:  []string{"GET comments page 1", "POST comments"},
+			comments2: []string{"lgtm", report("| Notify | File(s) |", "|-|-|", "| @{go} | file.go |", "| `@js` | file.js |", notifiedList("@go"))},
+		},
+		{
+			name:      "update on older page",
+			comments:  append([]string{report("No notifications.")}, fillerComments(100)...),
+			notifs:    map[string][]string{"@go": {"file.go"}},
+			requests:  []string{"GET comments page 1", "GET comments page 2", "PUT comments/1"},
+			comments2: append([]string{report("| Notify | File(s) |", "|-|-|", "| @{go} | file.go |", notifiedList("@go"))}, fillerComments(100)...),
+		},
+		{
+			name:      "delete",
+			opts:      func(o *options) { o.staleReport = staleDelete },
+			comments:  []string{"lgtm", report("| Notify | File(s) |", "|-|-|", "| @{go} | file.go |", notifiedList("@go"))},
+			notifs:    map[string][]string{},
+			requests:  []string{"GET comments page 1", "DELETE comments/2"},
+			comments2: []string{"lgtm"},
+		},
+		{
+			name:      "skip",
+			comments:  []string{"lgtm"},
+			notifs:    map[string][]string{},
+			requests:  []string{"GET comments page 1"},
+			comments2: []string{"lgtm"},
+		},
+	}, func(t *testing.T, f *fakeComments) commenter {
+		bb := &fakeBitbucketCloud{fakeComments: f}
+		bb.url = serve(t, bb)
+		return &bitbucketCloudPullRequest{client: newBitbucketCloudClient(bb.url, "bb-test"), repo: "work/repo", id: "42"}
+	})
+}
+
+func TestBitbucketCloudPullRequest(t *testing.T) {
+	bb := &fakeBitbucketCloud{fakeComments: &fakeComments{t: t}, commits: 150, author: "alice"}
+	bb.url = serve(t, bb)
+
+	pr := &bitbucketCloudPullRequest{client: newBitbucketCloudClient(bb.url, "bb-test"), repo: "work/repo", id: "42"}
+	info, err := pr.info()
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if info.Author.Nickname != "alice" {
+		t.Errorf("expected author alice; got %+v", info)
+	}
+
+	count, err := pr.commitCount()
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if count != 150 {
+		t.Errorf("expected 150 commits; got %d", count)
+	}
+}
+
+func TestCommentOnBitbucketServerPullRequest(t *testing.T) {
+	report := markdownReport("CODENOTIFY", "a", "b")
+
+	runCommentTests(t, []commentTest{
+		{
+			name:      "create",
+			comments:  []string{"lgtm"},
+			notifs:    map[string][]string{"@go": {"file.go"}, "@jane.doe@example.com:review": {"file.js"}},
+			requests:  []string{"GET activities start 0", "POST comments"},
+			comments2: []string{"lgtm", report("| Notify | File(s) |", "|-|-|", `| @"go" | file.go |`, `| @"jane.doe@example.com" (review) | file.js |`, notifiedList("@go", "@jane.doe@example.com"))},
+		},
+		{
+			name:      "update on older page",
+			comments:  append([]string{report("No notifications.")}, fillerComments(100)...),
+			notifs:    map[string][]string{"@go": {"file.go"}},
+			requests:  []string{"GET activities start 0", "GET activities start 100", "PUT comments/1 version 3"},
+			comments2: append([]string{report("| Notify | File(s) |", "|-|-|", `| @"go" | file.go |`, notifiedList("@go"))}, fillerComments(100)...),
+		},
+		{
+			name:      "delete",
+			opts:      func(o *options) { o.staleReport = staleDelete },
+			comments:  []string{"lgtm", report("| Notify | File(s) |", "|-|-|", `| @"go" | file.go |`, notifiedList("@go"))},
+			notifs:    map[string][]string{},
+			requests:  []string{"GET activities start 0", "DELETE comments/2 version 3"},
+			comments2: []string{"lgtm"},
+		},
+		{
+			name:      "skip",
+			comments:  []string{"lgtm"},
+			notifs:    map[string][]string{},
+			requests:  []string{"GET activities start 0"},
+			comments2: []string{"lgtm"},
+		},
+	}, func(t *testing.T, f *fakeComments) commenter {
+		url := serve(t, &fakeBitbucketServer{fakeComments: f})
+		return &bitbucketServerPullRequest{client: newBitbucketServerClient(url, "bbs-test"), repo: "PROJ/repo", id: "42"}
+	})
+}
+
+// fakeBitbucketCloud is an in-memory stand-in for the parts of the Bitbucket Cloud REST API
+// that codenotify uses, for pull request 42 of work/repo.
+type fakeBitbucketCloud struct {
+	*fakeComments
+	// url is the URL of the server, used for pagination links.
+	url string
+	// commits is the number of commits in the pull request.
+	commits int
+	// author is the nickname of the author of the pull request.
+	author string
+}
+
+func (f *fakeBitbucketCloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer bb-test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	const prefix = "/repositories/work/repo/pullrequests/42"
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	id := strings.TrimPrefix(path, "/comments/")
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page == 0 {
+		page = 1
+	}
+	next := func(total int) string {
+		if page*100 >= total {
+			return ""
+		}
+		return fmt.Sprintf("%s%s%s?pagelen=100&page=%d", f.url, prefix, path, page+1)
+	}
+
+	switch {
+	case r.Method == http.MethodGet && path == "":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"author": map[string]interface{}{"nickname": f.author},
+		})
+	case r.Method == http.MethodGet && path == "/commits":
+		values := []map[string]interface{}{}
+		for i := (page - 1) * 100; i < f.commits && len(values) < 100; i++ {
+			values = append(values, map[string]interface{}{})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"values": values, "next": next(f.commits)})
+	case r.Method == http.MethodGet && path == "/comments":
+		if page == 1 && r.URL.Query().Get("sort") != "-created_on" {
+			f.t.Errorf("expected comments sorted newest first; got %s", r.URL.RawQuery)
+		}
+		f.request("GET comments page %d", page)
+		values := []map[string]interface{}{}
+		for i := len(f.comments) - 1 - (page-1)*100; i >= 0 && len(values) < 100; i-- {
+			values = append(values, map[string]interface{}{
+				"id":      i + 1,
+				"content": map[string]interface{}{"raw": f.comments[i]},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"values": values, "next": next(len(f.comments))})
+	case r.Method == http.MethodPost && path == "/comments":
+		f.request("POST comments")
+		f.add(f.body(r))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodPut && id != path:
+		f.request("PUT comments/%s", id)
+		f.update(id, f.body(r))
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodDelete && id != path:
+		f.request("DELETE comments/%s", id)
+		f.delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.unexpected(w, r)
+	}
+}
+
+// body returns the raw content of the comment in the request.
+func (f *fakeBitbucketCloud) body(r *http.Request) string {
+	body := struct {
+		Content struct {
+			Raw string `json:"raw"`
+		} `json:"content"`
+	}{}
+	f.decodeBody(r, &body)
+	return body.Content.Raw
+}
+
+// fakeBitbucketServer is an in-memory stand-in for the parts of the Bitbucket Server REST API
+// that codenotify uses, for pull request 42 of PROJ/repo. Every comment has version 3.
+type fakeBitbucketServer struct {
+	*fakeComments
+}
+
+func (f *fakeBitbucketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer bbs-test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	const prefix = "/projects/PROJ/repos/repo/pull-requests/42"
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	id := strings.TrimPrefix(path, "/comments/")
+	switch {
+	case r.Method == http.MethodGet && path == "/activities":
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		f.request("GET activities start %d", start)
+
+		values := []map[string]interface{}{}
+		for i := len(f.comments) - 1 - start; i >= 0 && len(values) < limit; i-- {
+			values = append(values, map[string]interface{}{
+				"action":  "COMMENTED",
+				"comment": map[string]interface{}{"id": i + 1, "text": f.comments[i], "version": 3},
+			})
+			// Other activities are interleaved with comments.
+			values = append(values, map[string]interface{}{"action": "APPROVED"})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"values":        values,
+			"isLastPage":    start+limit >= len(f.comments),
+			"nextPageStart": start + limit,
+		})
+	case r.Method == http.MethodPost && path == "/comments":
+		f.request("POST comments")
+		text, _ := f.body(r)
+		f.add(text)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodPut && id != path:
+		text, version := f.body(r)
+		f.request("PUT comments/%s version %d", id, version)
+		if version != 3 {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.update(id, text)
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodDelete && id != path:
+		version := r.URL.Query().Get("version")
+		f.request("DELETE comments/%s version %s", id, version)
+		if version != "3" {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.unexpected(w, r)
+	}
+}
+
+// body returns the text and version of the comment in the request.
+func (f *fakeBitbucketServer) body(r *http.Request) (string, int) {
+	body := struct {
+		Text    string `json:"text"`
+		Version int    `json:"version"`
+	}{}
+	f.decodeBody(r, &body)
+	return body.Text, body.Version
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// chatFormats are the output formats that are webhook payloads of chat platforms.
+var chatFormats = map[string]func(o *options, w io.Writer, notifs map[string][]string) error{
+	"teams":      (*options).writeTeams,
+	"mattermost": (*options).writeMattermost,
+	"discord":    (*options).writeDiscord,
+}
+
+// chatSummary returns the first line of a chat message in markdown, which links to the pull request if its URL is known.
+func (o *options) chatSummary() string {
+	diff := o.diff()
+	if o.url != "" {
+		diff = "[" + diff + "](" + o.url + ")"
+	}
+	return fmt.Sprintf("[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in %s files for diff %s.", o.filename, diff)
+}
+
+// chatStatus returns the message to show instead of subscribers, if any.
+func (o *options) chatStatus(notifs map[string][]string) string {
+	switch {
+	case o.exceedsThreshold(notifs):
+		return fmt.Sprintf("Not notifying subscribers because the number of notifying subscribers (%d) has exceeded the threshold (%d).", len(notifs), o.subscriberThreshold)
+	case len(notifs) == 0:
+		return "No notifications."
+	}
+	return ""
+}
+
+// chatSubscribers returns the sorted subscribers of notifs.
+func chatSubscribers(notifs map[string][]string) []string {
+	subs := make([]string, 0, len(notifs))
+	for sub := range notifs {
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+	return subs
+}
+
+// chatSubscriber formats a subscriber with format, which is called with the identity that the handle
+// is mapped to on the chat platform, or an empty identity if the subscriber should not be mentioned
+// because they are unmapped or silent.
+func (o *options) chatSubscriber(sub string, format func(handle, id string) string) string {
+	handle, mode := splitSubscriber(sub)
+	id := o.chatMapping[handle]
+	if mode == modeSilent {
+		id = ""
+	}
+	text := format(handle, id)
+	if mode != modeMention {
+		text += " (" + string(mode) + ")"
+	}
+	return text
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writeTeams writes a Microsoft Teams message with an Adaptive Card for an incoming webhook.
+// Handles are mapped to user principal names or Microsoft Entra object IDs.
+// See https://learn.microsoft.com/en-us/microsoftteams/platform/task-modules-and-cards/cards/cards-format#mention-support-within-adaptive-cards
+func (o *options) writeTeams(w io.Writer, notifs map[string][]string) error {
+	type textBlock struct {
+		Type   string `json:"type"`
+		Text   string `json:"text"`
+		Wrap   bool   `json:"wrap"`
+		Weight string `json:"weight,omitempty"`
+	}
+	type entity struct {
+		Type      string `json:"type"`
+		Text      string `json:"text"`
+		Mentioned struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"mentioned"`
+	}
+	type action struct {
+		Type  string `json:"type"`
+		Title string `json:"title"`
+		URL   string `json:"url"`
+	}
+
+	body := []textBlock{{Type: "TextBlock", Text: o.chatSummary(), Wrap: true, Weight: "bolder"}}
+	entities := []entity{}
+	if status := o.chatStatus(notifs); status != "" {
+		body = append(body, textBlock{Type: "TextBlock", Text: status, Wrap: true})
+	} else {
+		for _, sub := range chatSubscribers(notifs) {
+			subscriber := o.chatSubscriber(sub, func(handle, id string) string {
+				if id == "" {
+					return handle
+				}
+				e := entity{Type: "mention", Text: "<at>" + handle + "</at>"}
+				e.Mentioned.ID = id
+				e.Mentioned.Name = handle
+				entities = append(entities, e)
+				return e.Text
+			})
+			body = append(body, textBlock{Type: "TextBlock", Text: subscriber + ": " + strings.Join(notifs[sub], ", "), Wrap: true})
+		}
+	}
+
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+		"msteams": map[string]interface{}{"entities": entities},
+	}
+	if o.url != "" {
+		card["actions"] = []action{{Type: "Action.OpenUrl", Title: "View pull request", URL: o.url}}
+	}
+
+	return writeJSON(w, map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content":     card,
+		}},
+	})
+}
+
+// writeMattermost writes a Mattermost incoming webhook payload with a markdown table.
+// Handles are mapped to Mattermost usernames.
+func (o *options) writeMattermost(w io.Writer, notifs map[string][]string) error {
+	lines := []string{o.chatSummary(), ""}
+	if status := o.chatStatus(notifs); status != "" {
+		lines = append(lines, status)
+	} else {
+		lines = append(lines, "| Notify | File(s) |", "|-|-|")
+		for _, sub := range chatSubscribers(notifs) {
+			subscriber := o.chatSubscriber(sub, func(handle, id string) string {
+				if id == "" {
+					// Mattermost mentions any @word, so use a code span to avoid it.
+					return "`" + handle + "`"
+				}
+				return "@" + strings.TrimPrefix(id, "@")
+			})
+			lines = append(lines, fmt.Sprintf("| %s | %s |", subscriber, strings.Join(notifs[sub], "<br>")))
+		}
+	}
+	return writeJSON(w, map[string]string{"text": strings.Join(lines, "\n")})
+}
+
+// writeDiscord writes a Discord webhook payload. Handles are mapped to Discord user IDs,
+// or role IDs prefixed with & (e.g. &123), and only mapped subscribers are mentioned.
+func (o *options) writeDiscord(w io.Writer, notifs map[string][]string) error {
+	users, roles := []string{}, []string{}
+	lines := []string{o.chatSummary()}
+	if status := o.chatStatus(notifs); status != "" {
+		lines = append(lines, status)
+	} else {
+		for _, sub := range chatSubscribers(notifs) {
+			subscriber := o.chatSubscriber(sub, func(handle, id string) string {
+				if id == "" {
+					return handle
+				}
+				if strings.HasPrefix(id, "&") {
+					roles = append(roles, strings.TrimPrefix(id, "&"))
+				} else {
+					users = append(users, id)
+				}
+				return "<@" + id + ">"
+			})
+			lines = append(lines, "- "+subscriber+": "+strings.Join(notifs[sub], ", "))
+		}
+	}
+	return writeJSON(w, map[string]interface{}{
+		"content": strings.Join(lines, "\n"),
+		// Only allow the mentions of mapped subscribers, not @everyone or mentions in file names.
+		"allowed_mentions": map[string][]string{
+			"parse": {},
+			"users": users,
+			"roles": roles,
+		},
+	})
+}
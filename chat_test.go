@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestWriteChatFormats(t *testing.T) {
+	notifs := map[string][]string{
+		"@go":          {"file.go", "dir/file.go"},
+		"@js":          {"file.js"},
+		"@lead:silent": {"file.go"},
+		"@web:review":  {"web/index.js"},
+	}
+	mapping := map[string]string{
+		"@go":   "go@example.com",
+		"@lead": "lead@example.com",
+		"@web":  "web-team",
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		url    string
+		notifs map[string][]string
+		// mapping overrides the default mapping.
+		mapping map[string]string
+		output  string
+	}{
+		{
+			name:   "teams",
+			format: "teams",
+			url:    "https://github.com/o/r/pull/1",
+			notifs: notifs,
+			output: `{
+				"type": "message",
+				"attachments": [{
+					"contentType": "application/vnd.microsoft.card.adaptive",
+					"content": {
+						"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+						"type": "AdaptiveCard",
+						"version": "1.4",
+						"body": [
+							{"type": "TextBlock", "text": "[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff [a...b](https://github.com/o/r/pull/1).", "wrap": true, "weight": "bolder"},
+							{"type": "TextBlock", "text": "<at>@go</at>: file.go, dir/file.go", "wrap": true},
+							{"type": "TextBlock", "text": "@js: file.js", "wrap": true},
+							{"type": "TextBlock", "text": "@lead (silent): file.go", "wrap": true},
+							{"type": "TextBlock", "text": "<at>@web</at> (review): web/index.js", "wrap": true}
+						],
+						"msteams": {"entities": [
+							{"type": "mention", "text": "<at>@go</at>", "mentioned": {"id": "go@example.com", "name": "@go"}},
+							{"type": "mention", "text": "<at>@web</at>", "mentioned": {"id": "web-team", "name": "@web"}}
+						]},
+						"actions": [{"type": "Action.OpenUrl", "title": "View pull request", "url": "https://github.com/o/r/pull/1"}]
+					}
+				}]
+			}`,
+		},
+		{
+			name:   "teams without notifications",
+			format: "teams",
+			output: `{
+				"type": "message",
+				"attachments": [{
+					"contentType": "application/vnd.microsoft.card.adaptive",
+					"content": {
+						"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+						"type": "AdaptiveCard",
+						"version": "1.4",
+						"body": [
+							{"type": "TextBlock", "text": "[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff a...b.", "wrap": true, "weight": "bolder"},
+							{"type": "TextBlock", "text": "No notifications.", "wrap": true}
+						],
+						"msteams": {"entities": []}
+					}
+				}]
+			}`,
+		},
+		{
+			name:    "mattermost",
+			format:  "mattermost",
+			notifs:  notifs,
+			mapping: map[string]string{"@go": "gopher", "@lead": "lead", "@web": "@web-team"},
+			output: `{"text": "[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff a...b.\n\n` +
+				`| Notify | File(s) |\n|-|-|\n` +
+				`| @gopher | file.go<br>dir/file.go |\n` +
+				"| `@js` | file.js |\\n" +
+				"| `@lead` (silent) | file.go |\\n" +
+				`| @web-team (review) | web/index.js |"}`,
+		},
+		{
+			name:    "discord",
+			format:  "discord",
+			url:     "https://github.com/o/r/pull/1",
+			notifs:  notifs,
+			mapping: map[string]string{"@go": "80351110224678912", "@lead": "1", "@web": "&165511591545143296"},
+			output: `{
+				"content": "[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff [a...b](https://github.com/o/r/pull/1).\n` +
+				`- <@80351110224678912>: file.go, dir/file.go\n` +
+				`- @js: file.js\n` +
+				`- @lead (silent): file.go\n` +
+				`- <@&165511591545143296> (review): web/index.js",
+				"allowed_mentions": {"parse": [], "users": ["80351110224678912"], "roles": ["165511591545143296"]}
+			}`,
+		},
+		{
+			name:   "discord threshold",
+			format: "discord",
+			notifs: map[string][]string{"@a": {"a"}, "@b": {"b"}, "@c": {"c"}, "@d": {"d"}, "@e": {"e"}},
+			output: `{
+				"content": "[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff a...b.\nNot notifying subscribers because the number of notifying subscribers (5) has exceeded the threshold (4).",
+				"allowed_mentions": {"parse": [], "users": [], "roles": []}
+			}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := options{
+				filename:            "CODENOTIFY",
+				format:              test.format,
+				baseRef:             "a",
+				headRef:             "b",
+				url:                 test.url,
+				subscriberThreshold: 4,
+				chatMapping:         mapping,
+			}
+			if test.mapping != nil {
+				o.chatMapping = test.mapping
+			}
+
+			buf := bytes.Buffer{}
+			if err := o.writeNotifications(&buf, test.notifs); err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+
+			var expected, actual interface{}
+			if err := json.Unmarshal([]byte(test.output), &expected); err != nil {
+				t.Fatalf("invalid expected output: %s", err)
+			}
+			if err := json.Unmarshal(buf.Bytes(), &actual); err != nil {
+				t.Fatalf("invalid JSON output: %s\n%s", err, buf.String())
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected:\n%s\ngot:\n%s", test.output, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commenter posts and updates the report comment on a pull request (or merge request) of a code host.
+type commenter interface {
+	// existingComment returns the id and body of the newest comment whose body starts with marker,
+	// or an empty id if there is none.
+	existingComment(marker string) (string, string, error)
+	// addComment adds a comment with the given body.
+	addComment(body string) error
+	// updateComment replaces the body of the comment with the given id.
+	updateComment(id, body string) error
+	// deleteComment deletes the comment with the given id.
+	deleteComment(id string) error
+	// mention returns the markup that mentions the subscriber with the given handle (e.g. @alice).
+	mention(handle string) string
+}
+
+// minimizer is implemented by commenters on code hosts that can minimize (i.e. collapse) comments.
+type minimizer interface {
+	// minimizeComment minimizes the comment with the given id as outdated, or unminimizes it.
+	minimizeComment(id string, minimize bool) error
+}
+
+// Values for options.staleReport, which is what happens to the report comment
+// when subscribers no longer match the changed files.
+const (
+	// staleUpdate updates the report, which says "No notifications." if nobody matches anymore.
+	staleUpdate = "update"
+	// staleDelete deletes the report if nobody matches anymore.
+	staleDelete = "delete"
+	// staleMinimize minimizes the report as outdated if nobody matches anymore (GitHub only).
+	staleMinimize = "minimize"
+	// staleStrikethrough keeps the subscribers that no longer match in the report, struck through.
+	staleStrikethrough = "strikethrough"
+)
+
+// parseStaleReport validates the value of the option name for stale reports, which defaults to staleUpdate.
+// Minimizing comments is only allowed if minimize is true.
+func parseStaleReport(name, value string, minimize bool) (string, error) {
+	switch value {
+	case "":
+		return staleUpdate, nil
+	case staleUpdate, staleDelete, staleStrikethrough:
+		return value, nil
+	case staleMinimize:
+		if minimize {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("invalid value for %s: %s", name, value)
+}
+
+// commentOn configures o to mention subscribers the way that c does, and returns
+// a print function that adds or updates the report comment using c.
+func commentOn(o *options, c commenter) func(map[string][]string) error {
+	o.mention = c.mention
+	return func(notifs map[string][]string) error {
+		return upsertReport(o, c, notifs)
+	}
+}
+
+// notifiedMarker starts the hidden list of the handles that the report comment has notified,
+// which is a JSON array at the end of the comment.
+const notifiedMarker = "<!-- codenotify:notified "
+
+// upsertReport adds or updates the report comment.
+// No comment is added if there are no notifications to send.
+//
+// Code hosts don't notify the subscribers that are mentioned by an edit, so subscribers
+// that previous versions of the report didn't notify are mentioned in a follow-up comment.
+func upsertReport(o *options, c commenter, notifs map[string][]string) error {
+	id, body, err := c.existingComment(markdownCommentTitle(o.filename))
+	if err != nil {
+		return err
+	}
+
+	mentioned := o.mentionedSubscribers(notifs)
+	if id == "" {
+		if len(notifs) == 0 {
+			fmt.Fprintln(verbose, "not adding a comment because there are no notifications to send")
+			return nil
+		}
+		comment := bytes.Buffer{}
+		if err := o.writeNotifications(&comment, notifs); err != nil {
+			return err
+		}
+		return c.addComment(withNotified(comment.String(), subscriberHandles(mentioned)))
+	}
+
+	if len(notifs) == 0 && o.staleReport == staleDelete {
+		fmt.Fprintln(verbose, "deleting the report because there are no notifications")
+		return c.deleteComment(id)
+	}
+
+	// Reports without the list were added by an older version, which notified all of their subscribers.
+	notified, ok := parseNotified(body)
+	if o.staleReport == staleStrikethrough {
+		o.unsubscribed = unsubscribed(notified, notifs)
+	}
+	newSubs := []string{}
+	for _, sub := range mentioned {
+		handle, _ := splitSubscriber(sub)
+		if ok && !notified[handle] {
+			newSubs = append(newSubs, sub)
+		}
+		notified[handle] = true
+	}
+
+	comment := bytes.Buffer{}
+	if err := o.writeNotifications(&comment, notifs); err != nil {
+		return err
+	}
+
+	// The follow-up comment is added first, so that subscribers are notified again
+	// rather than never if updating the report fails.
+	if len(newSubs) > 0 {
+		fmt.Fprintf(verbose, "notifying new subscribers: %s\n", strings.Join(subscriberHandles(newSubs), ", "))
+		if err := c.addComment(o.followUpComment(newSubs)); err != nil {
+			return err
+		}
+	}
+
+	handles := make([]string, 0, len(notified))
+	for handle := range notified {
+		handles = append(handles, handle)
+	}
+	sort.Strings(handles)
+	if err := c.updateComment(id, withNotified(comment.String(), handles)); err != nil {
+		return err
+	}
+
+	if m, ok := c.(minimizer); ok && o.staleReport == staleMinimize {
+		return m.minimizeComment(id, len(notifs) == 0)
+	}
+	return nil
+}
+
+// unsubscribed returns the sorted handles that were notified but are no longer subscribers in notifs.
+func unsubscribed(notified map[string]bool, notifs map[string][]string) []string {
+	current := map[string]bool{}
+	for sub := range notifs {
+		handle, _ := splitSubscriber(sub)
+		current[handle] = true
+	}
+
+	handles := []string{}
+	for handle := range notified {
+		if !current[handle] {
+			handles = append(handles, handle)
+		}
+	}
+	sort.Strings(handles)
+	return handles
+}
+
+// mentionedSubscribers returns the sorted subscribers that the report mentions,
+// which excludes silent subscribers and all subscribers if the threshold is exceeded.
+func (o *options) mentionedSubscribers(notifs map[string][]string) []string {
+	subs := []string{}
+	if o.exceedsThreshold(notifs) {
+		return subs
+	}
+	for _, sub := range chatSubscribers(notifs) {
+		if _, mode := splitSubscriber(sub); mode != modeSilent {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// subscriberHandles returns the handles of the subscribers.
+func subscriberHandles(subs []string) []string {
+	handles := make([]string, len(subs))
+	for i, sub := range subs {
+		handles[i], _ = splitSubscriber(sub)
+	}
+	return handles
+}
+
+// followUpComment returns the comment that mentions subscribers that the report didn't notify yet.
+func (o *options) followUpComment(subs []string) string {
+	mentions := make([]string, len(subs))
+	for i, sub := range subs {
+		mentions[i] = o.markdownSubscriber(sub)
+	}
+	return fmt.Sprintf("[Codenotify](https://github.com/sourcegraph/codenotify): Notifying new subscribers in %s files for diff %s: %s.\n", o.filename, o.diff(), strings.Join(mentions, ", "))
+}
+
+// withNotified returns the report comment with the hidden list of notified handles.
+// The list is omitted if the comment would not fit in markdownMaxLength, in which case
+// the next update considers all subscribers notified.
+func withNotified(comment string, handles []string) string {
+	list, err := json.Marshal(handles)
+	if err != nil {
+		return comment
+	}
+	// json.Marshal escapes > in handles, so the list can't end the HTML comment.
+	withList := comment + notifiedMarker + string(list) + " -->\n"
+	if len(withList) > markdownMaxLength {
+		return comment
+	}
+	return withList
+}
+
+// parseNotified returns the set of notified handles in the body of a report comment,
+// and false if the body has no list.
+func parseNotified(body string) (map[string]bool, bool) {
+	notified := map[string]bool{}
+	i := strings.LastIndex(body, notifiedMarker)
+	if i < 0 {
+		return notified, false
+	}
+	list := body[i+len(notifiedMarker):]
+	if j := strings.Index(list, " -->"); j >= 0 {
+		list = list[:j]
+	}
+
+	var handles []string
+	if err := json.Unmarshal([]byte(list), &handles); err != nil {
+		return notified, false
+	}
+	for _, handle := range handles {
+		notified[handle] = true
+	}
+	return notified, true
+}
+
+// newCommenter returns a commenter for the pull request (or merge request) number pr
+// of the repository repo on the given code host provider.
+// If apiURL is empty, the provider's public API is used.
+func newCommenter(provider, apiURL, repo, pr, token string) (commenter, error) {
+	if repo == "" || pr == "" {
+		return nil, fmt.Errorf("the repository and pull request must be set for provider %s", provider)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("env var CODENOTIFY_TOKEN not set")
+	}
+
+	switch provider {
+	case "gitlab":
+		if apiURL == "" {
+			apiURL = "https://gitlab.com/api/v4"
+		}
+		return &gitlabMergeRequest{client: newGitLabClient(apiURL, token), projectID: repo, iid: pr}, nil
+	case "gitea":
+		if apiURL == "" {
+			return nil, fmt.Errorf("the API URL must be set for provider %s", provider)
+		}
+		return &giteaPullRequest{client: newGiteaClient(apiURL, token), repo: repo, index: pr}, nil
+	case "bitbucket-cloud":
+		if apiURL == "" {
+			apiURL = "https://api.bitbucket.org/2.0"
+		}
+		return &bitbucketCloudPullRequest{client: newBitbucketCloudClient(apiURL, token), repo: repo, id: pr}, nil
+	case "bitbucket-server":
+		if apiURL == "" {
+			return nil, fmt.Errorf("the API URL must be set for provider %s", provider)
+		}
+		return &bitbucketServerPullRequest{client: newBitbucketServerClient(apiURL, token), repo: repo, id: pr}, nil
+	default:
+		return nil, fmt.Errorf("unsupported provider: %s", provider)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewCommenter(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		apiURL   string
+		repo     string
+		pr       string
+		token    string
+		want     commenter
+		err      string
+	}{
+		{
+			name:     "gitlab default API",
+			provider: "gitlab",
+			repo:     "group/project",
+			pr:       "7",
+			token:    "t",
+			want:     &gitlabMergeRequest{client: newGitLabClient("https://gitlab.com/api/v4", "t"), projectID: "group/project", iid: "7"},
+		},
+		{
+			name:     "gitea",
+			provider: "gitea",
+			apiURL:   "https://gitea.example.com/api/v1",
+			repo:     "owner/repo",
+			pr:       "7",
+			token:    "t",
+			want:     &giteaPullRequest{client: newGiteaClient("https://gitea.example.com/api/v1", "t"), repo: "owner/repo", index: "7"},
+		},
+		{
+			name:     "bitbucket cloud default API",
+			provider: "bitbucket-cloud",
+			repo:     "work/repo",
+			pr:       "7",
+			token:    "t",
+			want:     &bitbucketCloudPullRequest{client: newBitbucketCloudClient("https://api.bitbucket.org/2.0", "t"), repo: "work/repo", id: "7"},
+		},
+		{
+			name:     "bitbucket server",
+			provider: "bitbucket-server",
+			apiURL:   "https://bitbucket.example.com/rest/api/1.0",
+			repo:     "PROJ/repo",
+			pr:       "7",
+			token:    "t",
+			want:     &bitbucketServerPullRequest{client: newBitbucketServerClient("https://bitbucket.example.com/rest/api/1.0", "t"), repo: "PROJ/repo", id: "7"},
+		},
+		{
+			name:     "gitea requires API URL",
+			provider: "gitea",
+			repo:     "owner/repo",
+			pr:       "7",
+			token:    "t",
+			err:      "the API URL must be set for provider gitea",
+		},
+		{
+			name:     "missing pull request",
+			provider: "gitlab",
+			repo:     "group/project",
+			token:    "t",
+			err:      "the repository and pull request must be set for provider gitlab",
+		},
+		{
+			name:     "missing token",
+			provider: "gitlab",
+			repo:     "group/project",
+			pr:       "7",
+			err:      "env var CODENOTIFY_TOKEN not set",
+		},
+		{
+			name:     "unsupported provider",
+			provider: "svn",
+			repo:     "repo",
+			pr:       "7",
+			token:    "t",
+			err:      "unsupported provider: svn",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := newCommenter(test.provider, test.apiURL, test.repo, test.pr, test.token)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q; got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if !reflect.DeepEqual(test.want, c) {
+				t.Errorf("expected %+v; got %+v", test.want, c)
+			}
+		})
+	}
+}
+
+func TestParseNotified(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		notified map[string]bool
+		ok       bool
+	}{
+		{
+			name:     "list",
+			body:     withNotified("report\n", []string{"@go", "@org/js"}),
+			notified: map[string]bool{"@go": true, "@org/js": true},
+			ok:       true,
+		},
+		{
+			name:     "empty list",
+			body:     withNotified("report\n", []string{}),
+			notified: map[string]bool{},
+			ok:       true,
+		},
+		{
+			name:     "escaped",
+			body:     withNotified("report\n", []string{"@a-->b"}),
+			notified: map[string]bool{"@a-->b": true},
+			ok:       true,
+		},
+		{
+			name:     "no list",
+			body:     "report\n",
+			notified: map[string]bool{},
+		},
+		{
+			name:     "invalid list",
+			body:     "report\n" + notifiedMarker + "[@go] -->\n",
+			notified: map[string]bool{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			notified, ok := parseNotified(test.body)
+			if ok != test.ok || !reflect.DeepEqual(test.notified, notified) {
+				t.Errorf("expected %v, %t; got %v, %t", test.notified, test.ok, notified, ok)
+			}
+		})
+	}
+}
+
+func TestWithNotifiedLimit(t *testing.T) {
+	comment := strings.Repeat("x", markdownMaxLength-10)
+	if body := withNotified(comment, []string{"@go"}); body != comment {
+		t.Errorf("expected list to be omitted from a comment that would exceed the limit")
+	}
+}
+
+func TestParseStaleReport(t *testing.T) {
+	tests := []struct {
+		value    string
+		minimize bool
+		want     string
+		err      string
+	}{
+		{value: "", want: staleUpdate},
+		{value: "delete", want: staleDelete},
+		{value: "strikethrough", want: staleStrikethrough},
+		{value: "minimize", minimize: true, want: staleMinimize},
+		{value: "minimize", err: "invalid value for -stale-report: minimize"},
+		{value: "hide", minimize: true, err: "invalid value for -stale-report: hide"},
+	}
+
+	for _, test := range tests {
+		got, err := parseStaleReport("-stale-report", test.value, test.minimize)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("expected error %q for %q; got %v", test.err, test.value, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("expected %q for %q; got %q, %v", test.want, test.value, got, err)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// emailConfig configures the email notifications of a run.
+type emailConfig struct {
+	// addr is the host:port of the SMTP server.
+	addr string
+	// username and password authenticate with the SMTP server, if set.
+	username string
+	password string
+	// from is the sender of the emails.
+	from string
+	// mapping is the path of a file that maps handles to email addresses.
+	mapping string
+	// textTemplate and htmlTemplate are paths of templates that override the default
+	// text and HTML bodies of the emails.
+	textTemplate string
+	htmlTemplate string
+	// state is the path of a file that records sent emails so that they are not sent again.
+	state string
+}
+
+// enabled returns true if email notifications are configured.
+func (c *emailConfig) enabled() bool {
+	return c.addr != ""
+}
+
+// emailConfigFromEnv returns the email configuration from the env vars of n.
+func emailConfigFromEnv(n envNaming) emailConfig {
+	return emailConfig{
+		addr:         n.get("smtp-addr"),
+		username:     n.get("smtp-username"),
+		password:     n.get("smtp-password"),
+		from:         n.get("smtp-from"),
+		mapping:      n.get("email-mapping"),
+		textTemplate: n.get("email-text-template"),
+		htmlTemplate: n.get("email-html-template"),
+		state:        n.get("email-state"),
+	}
+}
+
+// addEmailFromEnv adds email notifications to o if they are configured by the env vars of n.
+func addEmailFromEnv(o *options, n envNaming) error {
+	config := emailConfigFromEnv(n)
+	if !config.enabled() {
+		return nil
+	}
+
+	print, err := notifyEmail(o, config)
+	if err != nil {
+		return err
+	}
+	o.addPrint(print)
+	return nil
+}
+
+// emailData is the data that email templates are executed with.
+type emailData struct {
+	// Handle is the handle of the subscriber.
+	Handle string
+	// Files are the changed files that the subscriber is subscribed to.
+	Files []string
+	// Filename is the filename in which file subscribers are defined (e.g. CODENOTIFY).
+	Filename string
+	// BaseRef and HeadRef are the refs of the diff. With -paths or -patch, the refs that aren't set are empty.
+	BaseRef string
+	HeadRef string
+	// Diff describes the diff (e.g. a1b2c3...d4e5f6, or worktree...stdin for -patch -).
+	Diff string
+	// URL is the web URL of the pull request, if known.
+	URL string
+}
+
+const defaultEmailSubject = `Files that you subscribe to changed in {{if .URL}}{{.URL}}{{else}}{{.Diff}}{{end}}`
+
+const defaultEmailText = `You ({{.Handle}}) are subscribed to changes to these files in {{.Filename}} files:
+
+{{range .Files}}  {{.}}
+{{end}}
+Diff: {{.Diff}}
+{{- if .URL}}
+Pull request: {{.URL}}
+{{- end}}
+
+Sent by Codenotify: https://github.com/sourcegraph/codenotify
+`
+
+const defaultEmailHTML = `<p>You ({{.Handle}}) are subscribed to changes to these files in {{.Filename}} files:</p>
+<ul>
+{{range .Files}}<li><code>{{.}}</code></li>
+{{end}}</ul>
+<p>Diff: <code>{{.Diff}}</code>
+{{- if .URL}}<br>Pull request: <a href="{{.URL}}">{{.URL}}</a>{{end}}</p>
+<p>Sent by <a href="https://github.com/sourcegraph/codenotify">Codenotify</a></p>
+`
+
+// emailState maps the key of a pull request to the files that each handle was emailed about.
+type emailState map[string]map[string][]string
+
+// emailNotifier sends notifications by email.
+type emailNotifier struct {
+	config  emailConfig
+	mapping map[string]string
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+// notifyEmail returns a print function that sends an email to each subscriber with an email address.
+// Silent subscribers are not emailed.
+func notifyEmail(o *options, config emailConfig) (func(map[string][]string) error, error) {
+	if config.from == "" {
+		return nil, fmt.Errorf("the sender of emails is required")
+	}
+	if _, err := mail.ParseAddress(config.from); err != nil {
+		return nil, fmt.Errorf("invalid sender of emails %q: %w", config.from, err)
+	}
+
+	e := &emailNotifier{config: config, mapping: map[string]string{}}
+	var err error
+	if config.mapping != "" {
+		e.mapping, err = readMapping(config.mapping)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e.subject = template.Must(template.New("subject").Parse(defaultEmailSubject))
+	textTemplate, htmlTemplate := defaultEmailText, defaultEmailHTML
+	if config.textTemplate != "" {
+		textTemplate, err = readTemplate(config.textTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.htmlTemplate != "" {
+		htmlTemplate, err = readTemplate(config.htmlTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if e.text, err = template.New("text").Parse(textTemplate); err != nil {
+		return nil, fmt.Errorf("invalid text email template: %w", err)
+	}
+	if e.html, err = htmltemplate.New("html").Parse(htmlTemplate); err != nil {
+		return nil, fmt.Errorf("invalid HTML email template: %w", err)
+	}
+
+	return func(notifs map[string][]string) error {
+		return e.send(o, notifs)
+	}, nil
+}
+
+func readTemplate(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("unable to read template: %w", err)
+	}
+	return string(data), nil
+}
+
+func (e *emailNotifier) send(o *options, notifs map[string][]string) error {
+	if o.exceedsThreshold(notifs) {
+		fmt.Fprintln(verbose, "not sending emails because the number of subscribers exceeds the threshold")
+		return nil
+	}
+
+	subs := make([]string, 0, len(notifs))
+	for sub := range notifs {
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+
+	var auth smtp.Auth
+	if e.config.username != "" {
+		host, _, err := net.SplitHostPort(e.config.addr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP server address %s: %w", e.config.addr, err)
+		}
+		auth = smtp.PlainAuth("", e.config.username, e.config.password, host)
+	}
+
+	state, err := e.readState()
+	if err != nil {
+		return err
+	}
+	// The key identifies the pull request, like the key of the Slack state.
+	key := o.url
+	if key == "" {
+		key = o.diff()
+	}
+	sent := state[key]
+	if sent == nil {
+		sent = map[string][]string{}
+	}
+	state[key] = sent
+
+	for _, sub := range subs {
+		handle, mode := splitSubscriber(sub)
+		if mode == modeSilent {
+			continue
+		}
+
+		to := e.address(handle)
+		if to == "" {
+			fmt.Fprintf(verbose, "not emailing %s because they have no email address\n", handle)
+			continue
+		}
+		if reflect.DeepEqual(sent[handle], notifs[sub]) {
+			fmt.Fprintf(verbose, "not emailing %s because they were already emailed about the same files\n", handle)
+			continue
+		}
+
+		msg, err := e.message(to, emailData{
+			Handle:   handle,
+			Files:    notifs[sub],
+			Filename: o.filename,
+			BaseRef:  o.baseRef,
+			HeadRef:  o.headRef,
+			Diff:     o.diff(),
+			URL:      o.url,
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(verbose, "emailing %s\n", handle)
+		recipient, err := mail.ParseAddress(to)
+		if err != nil {
+			return fmt.Errorf("invalid email address for %s: %w", handle, err)
+		}
+		from, _ := mail.ParseAddress(e.config.from)
+		if err := smtp.SendMail(e.config.addr, auth, from.Address, []string{recipient.Address}, msg); err != nil {
+			// Record the emails that were sent, so that they are not sent again when the run is retried.
+			if stateErr := e.writeState(state); stateErr != nil {
+				return stateErr
+			}
+			return redactError(fmt.Errorf("error emailing %s: %w", handle, err), e.config.password)
+		}
+		sent[handle] = notifs[sub]
+	}
+	return e.writeState(state)
+}
+
+func (e *emailNotifier) readState() (emailState, error) {
+	state := emailState{}
+	if e.config.state == "" {
+		return state, nil
+	}
+
+	data, err := ioutil.ReadFile(e.config.state)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read email state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("unable to decode email state %s: %w", e.config.state, err)
+	}
+	return state, nil
+}
+
+func (e *emailNotifier) writeState(state emailState) error {
+	if e.config.state == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(e.config.state, data, 0644); err != nil {
+		return fmt.Errorf("unable to write email state: %w", err)
+	}
+	return nil
+}
+
+// address returns the email address of a handle, which is either mapped
+// or the handle itself if it is an email address (e.g. qa@example.com).
+func (e *emailNotifier) address(handle string) string {
+	if address, ok := e.mapping[handle]; ok {
+		return address
+	}
+	if !strings.HasPrefix(handle, "@") {
+		if _, err := mail.ParseAddress(handle); err == nil {
+			return handle
+		}
+	}
+	return ""
+}
+
+// message returns a multipart email with text and HTML bodies.
+func (e *emailNotifier) message(to string, data emailData) ([]byte, error) {
+	subject := bytes.Buffer{}
+	if err := e.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+
+	body := bytes.Buffer{}
+	w := multipart.NewWriter(&body)
+	if err := writeEmailPart(w, "text/plain", func(b *bytes.Buffer) error { return e.text.Execute(b, data) }); err != nil {
+		return nil, fmt.Errorf("error executing text email template: %w", err)
+	}
+	if err := writeEmailPart(w, "text/html", func(b *bytes.Buffer) error { return e.html.Execute(b, data) }); err != nil {
+		return nil, fmt.Errorf("error executing HTML email template: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	messageID, err := e.messageID()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := bytes.Buffer{}
+	fmt.Fprintf(&msg, "From: %s\r\n", e.config.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: %s\r\n", messageID)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject.String()))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n", w.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// messageID returns a unique Message-ID in the domain of the sender (e.g. <1a2b3c...@example.com>).
+func (e *emailNotifier) messageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if from, err := mail.ParseAddress(e.config.from); err == nil {
+		domain = from.Address[strings.LastIndex(from.Address, "@")+1:]
+	}
+	return fmt.Sprintf("<%x@%s>", b, domain), nil
+}
+
+// writeEmailPart writes a quoted-printable part with the content written by execute.
+func writeEmailPart(w *multipart.Writer, contentType string, execute func(*bytes.Buffer) error) error {
+	content := bytes.Buffer{}
+	if err := execute(&content); err != nil {
+		return err
+	}
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write(content.Bytes()); err != nil {
+		return err
+	}
+	return qp.Close()
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNotifyEmail(t *testing.T) {
+	server := newFakeSMTP(t)
+
+	dir := t.TempDir()
+	mapping := filepath.Join(dir, "email-mapping")
+	writeFile(t, mapping, "@alice alice@example.com\n@org/qa QA Team <qa@example.com>\n")
+	config := emailConfig{
+		addr:     server.addr,
+		username: "codenotify",
+		password: "smtp-secret",
+		from:     "Codenotify <codenotify@example.com>",
+		mapping:  mapping,
+	}
+	o := &options{filename: "CODENOTIFY", baseRef: "a", headRef: "b", url: "https://github.com/o/r/pull/1"}
+	print, err := notifyEmail(o, config)
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+
+	if err := print(map[string][]string{
+		"@alice":              {"a.go", "<b>.go"},
+		"@org/qa:review":      {"qa/plan.md"},
+		"@lead:silent":        {"a.go"},
+		"@bob":                {"b.go"},
+		"docs@example.com":    {"docs/index.md"},
+		"@dba:silent":         {"db.sql"},
+		"contractor@example.": {"x.go"},
+	}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+
+	if len(server.messages) != 3 {
+		t.Fatalf("expected 3 emails; got %d", len(server.messages))
+	}
+
+	alice := server.messages[0]
+	if alice.from != "codenotify@example.com" || !reflect.DeepEqual(alice.to, []string{"alice@example.com"}) {
+		t.Errorf("expected email from codenotify@example.com to alice@example.com; got %s to %v", alice.from, alice.to)
+	}
+	if alice.auth != "codenotify:smtp-secret" {
+		t.Errorf("expected authentication as codenotify; got %q", alice.auth)
+	}
+
+	header, text, html := parseEmail(t, alice.data)
+	if header.Get("To") != "alice@example.com" || header.Get("From") != "Codenotify <codenotify@example.com>" {
+		t.Errorf("unexpected header: %v", header)
+	}
+	if subject := header.Get("Subject"); subject != "Files that you subscribe to changed in https://github.com/o/r/pull/1" {
+		t.Errorf("unexpected subject: %q", subject)
+	}
+	if _, err := header.Date(); err != nil {
+		t.Errorf("expected a valid Date header; got %s", err)
+	}
+	messageID := header.Get("Message-ID")
+	if !strings.HasPrefix(messageID, "<") || !strings.HasSuffix(messageID, "@example.com>") {
+		t.Errorf("unexpected Message-ID: %q", messageID)
+	}
+	if header, _, _ := parseEmail(t, server.messages[1].data); header.Get("Message-ID") == messageID {
+		t.Errorf("expected a different Message-ID for each email; got %q twice", messageID)
+	}
+	expectedText := strings.Join([]string{
+		"You (@alice) are subscribed to changes to these files in CODENOTIFY files:",
+		"",
+		"  a.go",
+		"  <b>.go",
+		"",
+		"Diff: a...b",
+		"Pull request: https://github.com/o/r/pull/1",
+		"",
+		"Sent by Codenotify: https://github.com/sourcegraph/codenotify",
+		"",
+	}, "\n")
+	if text != expectedText {
+		t.Errorf("expected text:\n%s\ngot:\n%s", expectedText, text)
+	}
+	if !strings.Contains(html, "<li><code>&lt;b&gt;.go</code></li>") {
+		t.Errorf("expected escaped file in HTML:\n%s", html)
+	}
+
+	qa := server.messages[1]
+	if !reflect.DeepEqual(qa.to, []string{"qa@example.com"}) {
+		t.Errorf("expected email to qa@example.com; got %v", qa.to)
+	}
+	if header, _, _ := parseEmail(t, qa.data); header.Get("To") != "QA Team <qa@example.com>" {
+		t.Errorf("expected To header with name; got %q", header.Get("To"))
+	}
+
+	docs := server.messages[2]
+	if !reflect.DeepEqual(docs.to, []string{"docs@example.com"}) {
+		t.Errorf("expected email to docs@example.com; got %v", docs.to)
+	}
+}
+
+func TestNotifyEmailTemplates(t *testing.T) {
+	server := newFakeSMTP(t)
+
+	dir := t.TempDir()
+	textTemplate := filepath.Join(dir, "email.txt")
+	writeFile(t, textTemplate, "{{.Handle}}: {{len .Files}} file(s) in {{.BaseRef}}...{{.HeadRef}}")
+	htmlTemplate := filepath.Join(dir, "email.html")
+	writeFile(t, htmlTemplate, "<b>{{.Handle}}</b>")
+	config := emailConfig{
+		addr:         server.addr,
+		from:         "codenotify@example.com",
+		textTemplate: textTemplate,
+		htmlTemplate: htmlTemplate,
+	}
+	print, err := notifyEmail(&options{baseRef: "a", headRef: "b"}, config)
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if err := print(map[string][]string{"qa@example.com": {"a.go", "b.go"}}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+
+	if len(server.messages) != 1 {
+		t.Fatalf("expected 1 email; got %d", len(server.messages))
+	}
+	if server.messages[0].auth != "" {
+		t.Errorf("expected no authentication; got %q", server.messages[0].auth)
+	}
+	header, text, html := parseEmail(t, server.messages[0].data)
+	if subject := header.Get("Subject"); subject != "Files that you subscribe to changed in a...b" {
+		t.Errorf("unexpected subject: %q", subject)
+	}
+	if text != "qa@example.com: 2 file(s) in a...b" {
+		t.Errorf("unexpected text: %q", text)
+	}
+	if html != "<b>qa@example.com</b>" {
+		t.Errorf("unexpected HTML: %q", html)
+	}
+}
+
+func TestNotifyEmailState(t *testing.T) {
+	server := newFakeSMTP(t)
+
+	state := filepath.Join(t.TempDir(), "email-state.json")
+	config := emailConfig{addr: server.addr, from: "codenotify@example.com", state: state}
+	o := &options{baseRef: "a", headRef: "b", url: "https://github.com/o/r/pull/1"}
+	print, err := notifyEmail(o, config)
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+
+	runs := []struct {
+		notifs map[string][]string
+		to     []string
+	}{
+		{
+			notifs: map[string][]string{"a@example.com": {"a.go"}, "b@example.com": {"b.go"}},
+			to:     []string{"a@example.com", "b@example.com"},
+		},
+		{
+			// Another push that doesn't change the files of the subscribers.
+			notifs: map[string][]string{"a@example.com": {"a.go"}, "b@example.com": {"b.go"}},
+		},
+		{
+			notifs: map[string][]string{"a@example.com": {"a.go", "c.go"}, "b@example.com": {"b.go"}},
+			to:     []string{"a@example.com"},
+		},
+	}
+	for i, run := range runs {
+		before := len(server.messages)
+		if err := print(run.notifs); err != nil {
+			t.Fatalf("run %d: expected nil error; got %s", i, err)
+		}
+		var to []string
+		for _, msg := range server.messages[before:] {
+			to = append(to, msg.to...)
+		}
+		if !reflect.DeepEqual(run.to, to) {
+			t.Errorf("run %d: expected emails to %v; got %v", i, run.to, to)
+		}
+	}
+
+	// The same files in another pull request are emailed again.
+	o.url = "https://github.com/o/r/pull/2"
+	before := len(server.messages)
+	if err := print(map[string][]string{"b@example.com": {"b.go"}}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if len(server.messages) != before+1 {
+		t.Errorf("expected 1 email for another pull request; got %d", len(server.messages)-before)
+	}
+}
+
+func TestNotifyEmailThreshold(t *testing.T) {
+	server := newFakeSMTP(t)
+
+	o := &options{subscriberThreshold: 1}
+	print, err := notifyEmail(o, emailConfig{addr: server.addr, from: "codenotify@example.com"})
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if err := print(map[string][]string{"a@example.com": {"a.go"}, "b@example.com": {"b.go"}}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if len(server.messages) != 0 {
+		t.Errorf("expected no emails; got %d", len(server.messages))
+	}
+}
+
+func TestNotifyEmailError(t *testing.T) {
+	server := newFakeSMTP(t)
+
+	config := emailConfig{addr: server.addr, username: "codenotify", password: "wrong-secret", from: "codenotify@example.com"}
+	print, err := notifyEmail(&options{}, config)
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	err = print(map[string][]string{"a@example.com": {"a.go"}})
+	if err == nil {
+		t.Fatal("expected error for invalid credentials")
+	}
+	if !strings.HasPrefix(err.Error(), "error emailing a@example.com: ") {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if strings.Contains(err.Error(), "wrong-secret") {
+		t.Errorf("expected password to be redacted from error:\n%s", err)
+	}
+}
+
+func TestNotifyEmailConfig(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.txt")
+	writeFile(t, invalid, "{{.Handle")
+
+	tests := []struct {
+		name   string
+		config emailConfig
+		err    string
+	}{
+		{
+			name:   "no sender",
+			config: emailConfig{addr: "localhost:25"},
+			err:    "the sender of emails is required",
+		},
+		{
+			name:   "invalid sender",
+			config: emailConfig{addr: "localhost:25", from: "codenotify"},
+			err:    `invalid sender of emails "codenotify": mail: missing '@' or angle-addr`,
+		},
+		{
+			name:   "invalid template",
+			config: emailConfig{addr: "localhost:25", from: "codenotify@example.com", textTemplate: invalid},
+			err:    "invalid text email template: template: text:1: unclosed action",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := notifyEmail(&options{}, test.config)
+			if err == nil || err.Error() != test.err {
+				t.Errorf("expected error %q; got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// parseEmail returns the header and the decoded text and HTML bodies of a multipart email.
+func parseEmail(t *testing.T, data []byte) (mail.Header, string, string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("unable to parse email: %s", err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("unable to decode subject: %s", err)
+	}
+	msg.Header["Subject"] = []string{subject}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative email; got %q (%v)", msg.Header.Get("Content-Type"), err)
+	}
+
+	bodies := map[string]string{}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("unable to read part: %s", err)
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		bodies[contentType] = string(body)
+	}
+	return msg.Header, bodies["text/plain"], bodies["text/html"]
+}
+
+// fakeSMTPMessage is an email received by fakeSMTP.
+type fakeSMTPMessage struct {
+	// auth is the username:password that the client authenticated with, if any.
+	auth string
+	from string
+	to   []string
+	data []byte
+}
+
+// fakeSMTP is an in-process SMTP server that accepts the credentials codenotify:smtp-secret.
+type fakeSMTP struct {
+	t    *testing.T
+	addr string
+
+	mu       sync.Mutex
+	messages []fakeSMTPMessage
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &fakeSMTP{t: t, addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost ESMTP")
+
+	msg := fakeSMTPMessage{}
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			parts := strings.Split(string(credentials), "\x00")
+			if len(parts) != 3 || parts[1] != "codenotify" || parts[2] != "smtp-secret" {
+				c.PrintfLine("535 5.7.8 Authentication credentials invalid")
+				continue
+			}
+			msg.auth = parts[1] + ":" + parts[2]
+			c.PrintfLine("235 2.7.0 Authentication successful")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = data
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			msg = fakeSMTPMessage{auth: msg.auth}
+			c.PrintfLine("250 OK")
+		case "RSET", "NOOP":
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 Command not implemented")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// envNaming is how the settings of a CI integration are named in env vars.
+type envNaming int
+
+const (
+	// actionInputs are the inputs of the GitHub and Gitea Actions (e.g. INPUT_SLACK-CHANNEL for slack-channel).
+	actionInputs envNaming = iota
+	// ciVariables are the variables of GitLab CI and Bitbucket Pipelines (e.g. CODENOTIFY_SLACK_CHANNEL),
+	// which are also the env vars of the secrets of the CLI.
+	ciVariables
+)
+
+// variable returns the env var of the setting name (e.g. slack-channel).
+func (n envNaming) variable(name string) string {
+	if n == actionInputs {
+		return "INPUT_" + strings.ToUpper(name)
+	}
+	return "CODENOTIFY_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// describe returns how errors refer to the setting name.
+func (n envNaming) describe(name string) string {
+	if n == actionInputs {
+		return "input " + name
+	}
+	return n.variable(name)
+}
+
+// get returns the value of the setting name.
+func (n envNaming) get(name string) string {
+	return os.Getenv(n.variable(name))
+}
+
+// applyEnv sets the settings of o that all CI integrations share (template, group, stale-report, rules-from
+// and subscription-changes) from the env vars that n names. minimize is whether the code host can minimize
+// stale reports.
+func (o *options) applyEnv(n envNaming, minimize bool) error {
+	if err := o.loadTemplate(n.get("template")); err != nil {
+		return err
+	}
+	if err := o.groupFromEnv(n.variable("group")); err != nil {
+		return err
+	}
+	var err error
+	o.staleReport, err = parseStaleReport(n.describe("stale-report"), n.get("stale-report"), minimize)
+	if err != nil {
+		return err
+	}
+	o.rulesFrom, err = parseRulesFrom(n.describe("rules-from"), n.get("rules-from"))
+	if err != nil {
+		return err
+	}
+	o.subscriptionChanges, err = parseSubscriptionChanges(n.describe("subscription-changes"), n.get("subscription-changes"))
+	return err
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestEnvNaming(t *testing.T) {
+	tests := []struct {
+		naming   envNaming
+		variable string
+		describe string
+	}{
+		{naming: actionInputs, variable: "INPUT_SLACK-CHANNEL", describe: "input slack-channel"},
+		{naming: ciVariables, variable: "CODENOTIFY_SLACK_CHANNEL", describe: "CODENOTIFY_SLACK_CHANNEL"},
+	}
+
+	for _, test := range tests {
+		if v := test.naming.variable("slack-channel"); v != test.variable {
+			t.Errorf("expected variable %q; got %q", test.variable, v)
+		}
+		if d := test.naming.describe("slack-channel"); d != test.describe {
+			t.Errorf("expected description %q; got %q", test.describe, d)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	setenv(t, "INPUT_GROUP", "true")
+	setenv(t, "INPUT_RULES-FROM", "head")
+	o := &options{}
+	if err := o.applyEnv(actionInputs, true); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if !o.group || o.rulesFrom != rulesFromHead || o.staleReport == "" || o.subscriptionChanges == "" {
+		t.Errorf("unexpected options %+v", o)
+	}
+
+	setenv(t, "CODENOTIFY_GROUP", "maybe")
+	err := (&options{}).applyEnv(ciVariables, false)
+	if expected := "invalid value for CODENOTIFY_GROUP: maybe"; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q; got %v", expected, err)
+	}
+}
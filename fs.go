@@ -3,8 +3,11 @@ package main
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
 type FS interface {
@@ -32,6 +35,7 @@ func (m memfile) Stat() (os.FileInfo, error) {
 }
 
 // gitfs implements the FS interface for files at a specific git revision.
+// If rev is empty, files are read from the index.
 type gitfs struct {
 	cwd string
 	rev string
@@ -47,3 +51,30 @@ func (g *gitfs) Open(name string) (File, error) {
 		Buffer: bytes.NewBuffer(buf),
 	}, nil
 }
+
+// worktreefs implements the FS interface for the files in the working tree of the git repository at cwd.
+// Names are relative to the root of the working tree, like the paths of a diff. If root is set, it is used
+// as the root without running git.
+type worktreefs struct {
+	cwd  string
+	root string
+}
+
+func (w *worktreefs) Open(name string) (File, error) {
+	if w.root == "" {
+		out, err := exec.Command("git", "-C", w.cwd, "rev-parse", "--show-toplevel").Output()
+		if err != nil {
+			return nil, fmt.Errorf("unable to find the root of the working tree: %w", err)
+		}
+		w.root = strings.TrimSpace(string(out))
+	}
+
+	f, err := os.Open(filepath.Join(w.root, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// gerritTag tags the review messages that codenotify posts, so that it can find the messages that it posted.
+// It has no autogenerated: prefix, because Gerrit hides messages with such tags by default.
+const gerritTag = "codenotify"
+
+// Values for the -gerrit-post flag.
+const (
+	// gerritPostMessage posts the report as a review message.
+	gerritPostMessage = "message"
+	// gerritPostCC adds subscribers to the change as CC (or as reviewers with the :review mode).
+	gerritPostCC = "cc"
+	// gerritPostBoth does both.
+	gerritPostBoth = "both"
+)
+
+// newGerritClient returns a client for the Gerrit REST API at serverURL (e.g. https://gerrit.example.com)
+// that authenticates with the HTTP credentials of an account.
+func newGerritClient(serverURL, username, password string) *restClient {
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return &restClient{
+		// Authenticated endpoints are under /a/.
+		url:            strings.TrimSuffix(serverURL, "/") + "/a",
+		header:         http.Header{"Authorization": {"Basic " + credentials}},
+		http:           &http.Client{},
+		responsePrefix: ")]}'",
+	}
+}
+
+// gerritChange is a patch set of a Gerrit change.
+type gerritChange struct {
+	client *restClient
+	// change identifies the change (e.g. 12345 or project~12345).
+	change string
+	// patchset is the number of the patch set, or "current" for the latest one.
+	patchset string
+}
+
+func (c *gerritChange) path() string {
+	return "/changes/" + url.PathEscape(c.change)
+}
+
+// gerritRevision is the subset of a patch set's attributes that codenotify uses.
+type gerritRevision struct {
+	// Sha is the commit of the patch set, which is the key of the revision in gerritChangeInfo.
+	Sha    string `json:"-"`
+	Number int    `json:"_number"`
+	Commit struct {
+		Parents []struct {
+			Commit string `json:"commit"`
+		} `json:"parents"`
+	} `json:"commit"`
+}
+
+// gerritChangeInfo is the subset of a change's attributes that codenotify uses.
+type gerritChangeInfo struct {
+	CurrentRevision string                     `json:"current_revision"`
+	Revisions       map[string]*gerritRevision `json:"revisions"`
+	WorkInProgress  bool                       `json:"work_in_progress"`
+	Owner           struct {
+		Username string `json:"username"`
+	} `json:"owner"`
+}
+
+func (c *gerritChange) info() (*gerritChangeInfo, error) {
+	info := &gerritChangeInfo{}
+	_, err := c.client.do(http.MethodGet, c.path()+"?o=ALL_REVISIONS&o=ALL_COMMITS&o=DETAILED_ACCOUNTS", nil, info)
+	return info, err
+}
+
+// revision returns the given patch set of the change, which is either a number or "current".
+func (info *gerritChangeInfo) revision(patchset string) (*gerritRevision, error) {
+	for sha, rev := range info.Revisions {
+		rev.Sha = sha
+		if patchset == "current" && sha == info.CurrentRevision || patchset == strconv.Itoa(rev.Number) {
+			return rev, nil
+		}
+	}
+	return nil, fmt.Errorf("patch set %s not found", patchset)
+}
+
+// gerritOptions configures o to review the patch set of a Gerrit change, diffed against its parent.
+// It returns nil options if the change is work in progress.
+func gerritOptions(o *options, c *gerritChange, post string) (*options, error) {
+	switch post {
+	case gerritPostMessage, gerritPostCC, gerritPostBoth:
+	default:
+		return nil, fmt.Errorf("invalid value for -gerrit-post: %s", post)
+	}
+
+	info, err := c.info()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.WorkInProgress {
+		fmt.Fprintln(verbose, "Not sending notifications for work in progress change.")
+		return nil, nil
+	}
+
+	rev, err := info.revision(c.patchset)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find patch set of change %s: %w", c.change, err)
+	}
+	if len(rev.Commit.Parents) == 0 {
+		return nil, fmt.Errorf("patch set %d of change %s has no parent", rev.Number, c.change)
+	}
+
+	o.baseRef = rev.Commit.Parents[0].Commit
+	o.headRef = rev.Sha
+	o.author = "@" + info.Owner.Username
+	// Review messages are plain text.
+	o.format = "text"
+	o.print = reviewGerritChange(o, c, strconv.Itoa(rev.Number), post)
+	return o, nil
+}
+
+// gerritReviewer is a ReviewerInput of the Gerrit REST API.
+type gerritReviewer struct {
+	Reviewer string `json:"reviewer"`
+	State    string `json:"state"`
+}
+
+// reviewGerritChange returns a print function that reviews the given patch set of the change:
+// it posts the report as a review message (once per patch set) and/or adds subscribers to the change.
+// Silent subscribers are not added, and subscribers with the :review mode are added as reviewers instead of CC.
+func reviewGerritChange(o *options, c *gerritChange, patchset string, post string) func(map[string][]string) error {
+	return func(notifs map[string][]string) error {
+		if len(notifs) == 0 {
+			fmt.Fprintln(verbose, "not reviewing the change because there are no notifications to send")
+			return nil
+		}
+
+		review := struct {
+			Message   string           `json:"message,omitempty"`
+			Tag       string           `json:"tag"`
+			Reviewers []gerritReviewer `json:"reviewers,omitempty"`
+		}{Tag: gerritTag}
+
+		if post != gerritPostCC {
+			posted, err := c.hasMessage(patchset)
+			if err != nil {
+				return err
+			}
+			if posted {
+				fmt.Fprintf(verbose, "not posting a message because patch set %s already has one\n", patchset)
+			} else {
+				message := bytes.Buffer{}
+				if err := o.writeNotifications(&message, notifs); err != nil {
+					return err
+				}
+				review.Message = message.String()
+			}
+		}
+
+		if post != gerritPostMessage && !o.exceedsThreshold(notifs) {
+			subs := make([]string, 0, len(notifs))
+			for sub := range notifs {
+				subs = append(subs, sub)
+			}
+			sort.Strings(subs)
+
+			for _, sub := range subs {
+				handle, mode := splitSubscriber(sub)
+				switch mode {
+				case modeSilent:
+					continue
+				case modeReview:
+					review.Reviewers = append(review.Reviewers, gerritReviewer{Reviewer: gerritAccount(handle), State: "REVIEWER"})
+				default:
+					review.Reviewers = append(review.Reviewers, gerritReviewer{Reviewer: gerritAccount(handle), State: "CC"})
+				}
+			}
+		}
+
+		if review.Message == "" && len(review.Reviewers) == 0 {
+			return nil
+		}
+
+		fmt.Fprintf(verbose, "reviewing patch set %s of change %s\n", patchset, c.change)
+		_, err := c.client.do(http.MethodPost, c.path()+"/revisions/"+url.PathEscape(patchset)+"/review", review, nil)
+		return err
+	}
+}
+
+// hasMessage returns true if codenotify already posted a message on the patch set.
+func (c *gerritChange) hasMessage(patchset string) (bool, error) {
+	messages := []struct {
+		Tag            string `json:"tag"`
+		RevisionNumber int    `json:"_revision_number"`
+	}{}
+	if _, err := c.client.do(http.MethodGet, c.path()+"/messages", nil, &messages); err != nil {
+		return false, err
+	}
+
+	for _, m := range messages {
+		if m.Tag == gerritTag && strconv.Itoa(m.RevisionNumber) == patchset {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// gerritAccount returns the account identifier (username, email or group) for a subscriber handle.
+func gerritAccount(handle string) string {
+	return strings.TrimPrefix(handle, "@")
+}
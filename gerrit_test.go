@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGerritOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		patchset string
+		wip      bool
+		base     string
+		head     string
+		err      string
+	}{
+		{
+			name:     "current patch set",
+			patchset: "current",
+			base:     "parent2",
+			head:     "sha2",
+		},
+		{
+			name:     "older patch set",
+			patchset: "1",
+			base:     "parent1",
+			head:     "sha1",
+		},
+		{
+			name:     "unknown patch set",
+			patchset: "3",
+			err:      "unable to find patch set of change 42: patch set 3 not found",
+		},
+		{
+			name:     "work in progress",
+			patchset: "current",
+			wip:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gerrit := &fakeGerrit{t: t, wip: test.wip}
+			server := httptest.NewServer(gerrit)
+			defer server.Close()
+
+			c := &gerritChange{client: newGerritClient(server.URL, "bot", "secret"), change: "42", patchset: test.patchset}
+			o, err := gerritOptions(&options{filename: "CODENOTIFY"}, c, gerritPostBoth)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q; got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+
+			if test.wip {
+				if o != nil {
+					t.Errorf("expected nil options for work in progress change; got %+v", o)
+				}
+				return
+			}
+			if o.baseRef != test.base || o.headRef != test.head {
+				t.Errorf("expected diff %s...%s; got %s...%s", test.base, test.head, o.baseRef, o.headRef)
+			}
+			if o.author != "@owner" {
+				t.Errorf("expected author @owner; got %s", o.author)
+			}
+			if o.format != "text" {
+				t.Errorf("expected text format; got %s", o.format)
+			}
+		})
+	}
+
+	t.Run("invalid post", func(t *testing.T) {
+		c := &gerritChange{client: newGerritClient("http://gerrit.invalid", "bot", "secret"), change: "42", patchset: "current"}
+		_, err := gerritOptions(&options{}, c, "email")
+		if err == nil || err.Error() != "invalid value for -gerrit-post: email" {
+			t.Errorf("expected invalid value error; got %v", err)
+		}
+	})
+}
+
+func TestReviewGerritChange(t *testing.T) {
+	opts := options{
+		filename: "CODENOTIFY",
+		format:   "text",
+		baseRef:  "a",
+		headRef:  "b",
+	}
+	notifs := map[string][]string{
+		"@go":                    {"file.go"},
+		"@lead:silent":           {"file.go"},
+		"dba@example.com:review": {"db/schema.sql"},
+	}
+	message := joinLines([]string{"a...b", "@go -> file.go", "@lead (silent) -> file.go", "dba@example.com (review) -> db/schema.sql"})
+	reviewers := []gerritReviewer{
+		{Reviewer: "go", State: "CC"},
+		{Reviewer: "dba@example.com", State: "REVIEWER"},
+	}
+
+	tests := []struct {
+		name      string
+		post      string
+		messages  []fakeGerritMessage
+		notifs    map[string][]string
+		threshold int
+		requests  []string
+		reviews   []fakeGerritReview
+	}{
+		{
+			name:     "message and cc",
+			post:     gerritPostBoth,
+			messages: []fakeGerritMessage{{Tag: "autogenerated:ci", RevisionNumber: 2}, {Tag: gerritTag, RevisionNumber: 1}},
+			notifs:   notifs,
+			requests: []string{"GET messages", "POST revisions/2/review"},
+			// Gerrit hides messages with an autogenerated: tag by default.
+			reviews: []fakeGerritReview{{Message: message, Tag: "codenotify", Reviewers: reviewers}},
+		},
+		{
+			name:     "message only",
+			post:     gerritPostMessage,
+			notifs:   notifs,
+			requests: []string{"GET messages", "POST revisions/2/review"},
+			reviews:  []fakeGerritReview{{Message: message, Tag: gerritTag}},
+		},
+		{
+			name:     "cc only",
+			post:     gerritPostCC,
+			notifs:   notifs,
+			requests: []string{"POST revisions/2/review"},
+			reviews:  []fakeGerritReview{{Tag: gerritTag, Reviewers: reviewers}},
+		},
+		{
+			name:     "patch set already has a message",
+			post:     gerritPostBoth,
+			messages: []fakeGerritMessage{{Tag: gerritTag, RevisionNumber: 2}},
+			notifs:   notifs,
+			requests: []string{"GET messages", "POST revisions/2/review"},
+			reviews:  []fakeGerritReview{{Tag: gerritTag, Reviewers: reviewers}},
+		},
+		{
+			name:     "message already posted and message only",
+			post:     gerritPostMessage,
+			messages: []fakeGerritMessage{{Tag: gerritTag, RevisionNumber: 2}},
+			notifs:   notifs,
+			requests: []string{"GET messages"},
+		},
+		{
+			name:      "threshold exceeded",
+			post:      gerritPostBoth,
+			notifs:    notifs,
+			threshold: 2,
+			requests:  []string{"GET messages", "POST revisions/2/review"},
+			reviews: []fakeGerritReview{{
+				Message: joinLines([]string{"Not notifying subscribers because the number of notifying subscribers (3) has exceeded the threshold (2)."}),
+				Tag:     gerritTag,
+			}},
+		},
+		{
+			name:   "no notifications",
+			post:   gerritPostBoth,
+			notifs: map[string][]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gerrit := &fakeGerrit{t: t, messages: test.messages}
+			server := httptest.NewServer(gerrit)
+			defer server.Close()
+
+			c := &gerritChange{client: newGerritClient(server.URL, "bot", "secret"), change: "42", patchset: "current"}
+			o := opts
+			o.subscriberThreshold = test.threshold
+			if err := reviewGerritChange(&o, c, "2", test.post)(test.notifs); err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+
+			if !reflect.DeepEqual(test.requests, gerrit.requests) {
+				t.Errorf("expected requests %q; got %q", test.requests, gerrit.requests)
+			}
+			if !reflect.DeepEqual(test.reviews, gerrit.reviews) {
+				t.Errorf("expected reviews:\n%+v\ngot:\n%+v", test.reviews, gerrit.reviews)
+			}
+		})
+	}
+}
+
+func TestReviewGerritChangeError(t *testing.T) {
+	gerrit := &fakeGerrit{t: t}
+	server := httptest.NewServer(gerrit)
+	defer server.Close()
+
+	c := &gerritChange{client: newGerritClient(server.URL, "bot", "wrong"), change: "42", patchset: "current"}
+	err := reviewGerritChange(&options{format: "text"}, c, "2", gerritPostBoth)(map[string][]string{"@go": {"file.go"}})
+	if err == nil {
+		t.Fatal("expected error for invalid credentials")
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte("bot:wrong"))
+	if strings.Contains(err.Error(), credentials) {
+		t.Errorf("expected credentials to be redacted from error:\n%s", err)
+	}
+}
+
+// fakeGerritMessage is a ChangeMessageInfo of the Gerrit REST API.
+type fakeGerritMessage struct {
+	Tag            string `json:"tag"`
+	RevisionNumber int    `json:"_revision_number"`
+}
+
+// fakeGerritReview is a ReviewInput of the Gerrit REST API.
+type fakeGerritReview struct {
+	Message   string           `json:"message"`
+	Tag       string           `json:"tag"`
+	Reviewers []gerritReviewer `json:"reviewers"`
+}
+
+// fakeGerrit is an in-memory stand-in for the parts of the Gerrit REST API that codenotify uses,
+// for change 42 with two patch sets.
+type fakeGerrit struct {
+	t *testing.T
+	// wip is true if the change is work in progress.
+	wip bool
+	// messages are the messages on the change.
+	messages []fakeGerritMessage
+
+	// requests summarizes the requests that were made, in order.
+	requests []string
+	// reviews are the reviews that were posted, in order.
+	reviews []fakeGerritReview
+}
+
+func (f *fakeGerrit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username != "bot" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized")
+		return
+	}
+
+	const prefix = "/a/changes/42"
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	var response interface{}
+	switch {
+	case r.Method == http.MethodGet && path == "":
+		revision := func(number int, parent string) map[string]interface{} {
+			return map[string]interface{}{
+				"_number": number,
+				"commit": map[string]interface{}{
+					"parents": []map[string]interface{}{{"commit": parent}},
+				},
+			}
+		}
+		response = map[string]interface{}{
+			"current_revision": "sha2",
+			"work_in_progress": f.wip,
+			"owner":            map[string]interface{}{"username": "owner"},
+			"revisions": map[string]interface{}{
+				"sha1": revision(1, "parent1"),
+				"sha2": revision(2, "parent2"),
+			},
+		}
+	case r.Method == http.MethodGet && path == "/messages":
+		f.requests = append(f.requests, "GET messages")
+		response = f.messages
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/revisions/"):
+		f.requests = append(f.requests, "POST "+strings.TrimPrefix(path, "/"))
+		review := fakeGerritReview{}
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			f.t.Errorf("unable to decode review: %s", err)
+		}
+		f.reviews = append(f.reviews, review)
+		response = map[string]interface{}{}
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Gerrit prefixes JSON responses to prevent XSSI.
+	fmt.Fprintln(w, ")]}'")
+	json.NewEncoder(w).Encode(response)
+}
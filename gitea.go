@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// newGiteaClient returns a client for the Gitea (or Forgejo) REST API at apiURL
+// (e.g. https://gitea.com/api/v1) that authenticates with an access token.
+func newGiteaClient(apiURL, token string) *restClient {
+	return &restClient{
+		url:    apiURL,
+		header: http.Header{"Authorization": {"token " + token}},
+		http:   &http.Client{},
+	}
+}
+
+// giteaPullRequest implements commenter for a Gitea or Forgejo pull request.
+type giteaPullRequest struct {
+	client *restClient
+	// repo is the full name of the repository (owner/name).
+	repo  string
+	index string
+}
+
+func (pr *giteaPullRequest) repoPath() string {
+	return "/repos/" + escapePathSegments(pr.repo)
+}
+
+// giteaActionOptions returns options for running in Gitea or Forgejo Actions,
+// which are compatible with GitHub Actions.
+func giteaActionOptions() (*options, error) {
+	event, err := readPullRequestEvent()
+	if err != nil {
+		return nil, err
+	}
+
+	if event.Draft {
+		fmt.Fprintln(verbose, "Not sending notifications for draft pull request.")
+		return nil, nil
+	}
+
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("GITHUB_TOKEN is not set")
+	}
+
+	apiURL := os.Getenv("GITHUB_API_URL")
+	if apiURL == "" {
+		apiURL = strings.TrimSuffix(os.Getenv("GITHUB_SERVER_URL"), "/") + "/api/v1"
+	}
+
+	pr := &giteaPullRequest{
+		client: newGiteaClient(apiURL, token),
+		repo:   os.Getenv("GITHUB_REPOSITORY"),
+		index:  strconv.Itoa(event.Number),
+	}
+
+	commitCount, err := pr.commitCount()
+	if err != nil {
+		return nil, err
+	}
+
+	cwd := os.Getenv("GITHUB_WORKSPACE")
+	if err := deepen(cwd, commitCount); err != nil {
+		return nil, err
+	}
+
+	filename := os.Getenv("INPUT_FILENAME")
+	if filename == "" {
+		return nil, fmt.Errorf("env var INPUT_FILENAME not set")
+	}
+
+	subscriberThreshold, _ := strconv.Atoi(os.Getenv("INPUT_SUBSCRIBER-THRESHOLD"))
+
+	o := &options{
+		cwd:                 cwd,
+		format:              "markdown",
+		filename:            filename,
+		subscriberThreshold: subscriberThreshold,
+		baseRef:             event.Base.Sha,
+		headRef:             event.Head.Sha,
+		author:              "@" + event.User.Login,
+		url:                 event.HTMLURL,
+	}
+	if err := o.applyEnv(actionInputs, false); err != nil {
+		return nil, err
+	}
+	o.print = commentOn(o, pr)
+	if err := addSinksFromEnv(o, actionInputs); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// commitCount returns the number of commits in the pull request.
+func (pr *giteaPullRequest) commitCount() (int, error) {
+	commits := []struct{}{}
+	header, err := pr.client.do(http.MethodGet, pr.repoPath()+"/pulls/"+url.PathEscape(pr.index)+"/commits?limit=1", nil, &commits)
+	if err != nil {
+		return 0, err
+	}
+
+	total, err := strconv.Atoi(header.Get("X-Total-Count"))
+	if err != nil {
+		return 0, fmt.Errorf("unable to count commits in pull request %s: invalid X-Total-Count header %q", pr.index, header.Get("X-Total-Count"))
+	}
+	return total, nil
+}
+
+// giteaCommentsPageSize is the number of comments requested per page.
+const giteaCommentsPageSize = 50
+
+// existingComment searches all comments, because Gitea only lists them oldest first.
+func (pr *giteaPullRequest) existingComment(marker string) (string, string, error) {
+	id, body := "", ""
+	for page := 1; ; page++ {
+		comments := []struct {
+			ID   int64  `json:"id"`
+			Body string `json:"body"`
+		}{}
+		path := fmt.Sprintf("%s/issues/%s/comments?page=%d&limit=%d", pr.repoPath(), url.PathEscape(pr.index), page, giteaCommentsPageSize)
+		if _, err := pr.client.do(http.MethodGet, path, nil, &comments); err != nil {
+			return "", "", err
+		}
+
+		for _, comment := range comments {
+			if strings.HasPrefix(comment.Body, marker) {
+				id, body = strconv.FormatInt(comment.ID, 10), comment.Body
+			}
+		}
+
+		if len(comments) < giteaCommentsPageSize {
+			return id, body, nil
+		}
+	}
+}
+
+func (pr *giteaPullRequest) addComment(body string) error {
+	fmt.Fprintf(verbose, "adding comment to pull request %s\n", pr.index)
+	_, err := pr.client.do(http.MethodPost, pr.repoPath()+"/issues/"+url.PathEscape(pr.index)+"/comments", map[string]string{"body": body}, nil)
+	return err
+}
+
+func (pr *giteaPullRequest) updateComment(id, body string) error {
+	fmt.Fprintf(verbose, "updating existing comment: %s\n", id)
+	_, err := pr.client.do(http.MethodPatch, pr.repoPath()+"/issues/comments/"+url.PathEscape(id), map[string]string{"body": body}, nil)
+	return err
+}
+
+func (pr *giteaPullRequest) deleteComment(id string) error {
+	fmt.Fprintf(verbose, "deleting comment: %s\n", id)
+	_, err := pr.client.do(http.MethodDelete, pr.repoPath()+"/issues/comments/"+url.PathEscape(id), nil, nil)
+	return err
+}
+
+func (pr *giteaPullRequest) mention(handle string) string {
+	return handle
+}
+
+// escapePathSegments escapes each slash separated segment of p for use in a URL path.
+func escapePathSegments(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCommentOnGiteaPullRequest(t *testing.T) {
+	report := markdownReport("CODENOTIFY", "a", "b")
+
+	runCommentTests(t, []commentTest{
+		{
+			name:      "create",
+			comments:  []string{"lgtm"},
+			notifs:    map[string][]string{"@go": {"file.go"}},
+			requests:  []string{"GET comments page 1", "POST comments"},
+			comments2: []string{"lgtm", report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))},
+		},
+		{
+			name:      "update newest report",
+			comments:  append(append([]string{report("old")}, fillerComments(60)...), report("newer")),
+			notifs:    map[string][]string{"@go": {"file.go"}},
+			requests:  []string{"GET comments page 1", "GET comments page 2", "PATCH comments/62"},
+			comments2: append(append([]string{report("old")}, fillerComments(60)...), report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))),
+		},
+		{
+			name:      "delete",
+			opts:      func(o *options) { o.staleReport = staleDelete },
+			comments:  []string{"lgtm", report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))},
+			notifs:    map[string][]string{},
+			requests:  []string{"GET comments page 1", "DELETE comments/2"},
+			comments2: []string{"lgtm"},
+		},
+		{
+			name:      "skip",
+			comments:  fillerComments(50),
+			notifs:    map[string][]string{},
+			requests:  []string{"GET comments page 1", "GET comments page 2"},
+			comments2: fillerComments(50),
+		},
+	}, func(t *testing.T, f *fakeComments) commenter {
+		url := serve(t, &fakeGitea{fakeComments: f})
+		return &giteaPullRequest{client: newGiteaClient(url, "gitea-test"), repo: "octo/repo", index: "42"}
+	})
+}
+
+func TestGiteaCommitCount(t *testing.T) {
+	url := serve(t, &fakeGitea{fakeComments: &fakeComments{t: t}, commits: 5})
+	pr := &giteaPullRequest{client: newGiteaClient(url, "gitea-test"), repo: "octo/repo", index: "42"}
+	count, err := pr.commitCount()
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if count != 5 {
+		t.Errorf("expected 5 commits; got %d", count)
+	}
+}
+
+// fakeGitea is an in-memory stand-in for the parts of the Gitea REST API
+// that codenotify uses, for pull request 42 of octo/repo.
+type fakeGitea struct {
+	*fakeComments
+	// commits is the number of commits in the pull request.
+	commits int
+}
+
+func (f *fakeGitea) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "token gitea-test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	const commentPrefix = "/repos/octo/repo/issues/comments/"
+	id := strings.TrimPrefix(r.URL.Path, commentPrefix)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/repos/octo/repo/pulls/42/commits":
+		w.Header().Set("X-Total-Count", strconv.Itoa(f.commits))
+		fmt.Fprint(w, "[{}]")
+	case r.Method == http.MethodGet && r.URL.Path == "/repos/octo/repo/issues/42/comments":
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		f.request("GET comments page %d", page)
+
+		comments := []map[string]interface{}{}
+		for i := (page - 1) * limit; i < len(f.comments) && len(comments) < limit; i++ {
+			comments = append(comments, map[string]interface{}{"id": i + 1, "body": f.comments[i]})
+		}
+		json.NewEncoder(w).Encode(comments)
+	case r.Method == http.MethodPost && r.URL.Path == "/repos/octo/repo/issues/42/comments":
+		f.request("POST comments")
+		f.add(f.body(r))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodPatch && id != r.URL.Path:
+		f.request("PATCH comments/%s", id)
+		f.update(id, f.body(r))
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodDelete && id != r.URL.Path:
+		f.request("DELETE comments/%s", id)
+		f.delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.unexpected(w, r)
+	}
+}
+
+// body returns the body of the comment in the request.
+func (f *fakeGitea) body(r *http.Request) string {
+	body := struct {
+		Body string `json:"body"`
+	}{}
+	f.decodeBody(r, &body)
+	return body.Body
+}
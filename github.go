@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// githubClient is a client for the GitHub GraphQL API.
+type githubClient struct {
+	// url is the GraphQL endpoint (e.g. https://api.github.com/graphql).
+	url string
+	// token is used to authenticate requests.
+	token string
+	// http sends requests to the API.
+	http *http.Client
+	// retryBudget is the maximum total time spent waiting before retrying queries.
+	retryBudget time.Duration
+}
+
+// newGitHubClientFromEnv returns a client configured by the environment variables that are set in GitHub Actions.
+// If the app-id and app-private-key inputs are set, the client authenticates as that GitHub App's installation
+// on the repository, otherwise with GITHUB_TOKEN.
+func newGitHubClientFromEnv() (*githubClient, error) {
+	url := os.Getenv("GITHUB_GRAPHQL_URL")
+	if url == "" {
+		return nil, fmt.Errorf("GITHUB_GRAPHQL_URL is not set")
+	}
+
+	c := &githubClient{
+		url:         url,
+		http:        &http.Client{},
+		retryBudget: time.Minute,
+	}
+
+	appID := os.Getenv("INPUT_APP-ID")
+	if appID == "" {
+		c.token = os.Getenv("GITHUB_TOKEN")
+		if c.token == "" {
+			return nil, fmt.Errorf("GITHUB_TOKEN is not set")
+		}
+		return c, nil
+	}
+
+	key, err := parsePrivateKey([]byte(os.Getenv("INPUT_APP-PRIVATE-KEY")))
+	if err != nil {
+		return nil, err
+	}
+
+	app := &githubApp{
+		apiURL: os.Getenv("GITHUB_API_URL"),
+		appID:  appID,
+		key:    key,
+		http:   c.http,
+	}
+	c.token, err = app.installationToken(os.Getenv("GITHUB_REPOSITORY"), os.Getenv("INPUT_APP-INSTALLATION-ID"))
+	if err != nil {
+		return nil, err
+	}
+	// Ask the runner to mask the generated token in the logs.
+	fmt.Printf("::add-mask::%s\n", c.token)
+	return c, nil
+}
+
+func commentOnGitHubPullRequest(o *options, c *githubClient, prNodeID string) func(map[string][]string) error {
+	report := commentOn(o, &githubPullRequest{client: c, nodeID: prNodeID})
+	return func(notifs map[string][]string) error {
+		if o.comment {
+			if err := report(notifs); err != nil {
+				return err
+			}
+		}
+
+		if o.exceedsThreshold(notifs) {
+			return nil
+		}
+
+		return c.requestReviews(prNodeID, o.reviewers(notifs))
+	}
+}
+
+// githubPullRequest implements commenter and minimizer for a GitHub pull request.
+type githubPullRequest struct {
+	client *githubClient
+	nodeID string
+	// minimized is the set of ids of existing comments that are minimized.
+	minimized map[string]bool
+}
+
+func (pr *githubPullRequest) existingComment(marker string) (string, string, error) {
+	comment, err := pr.client.existingComment(pr.nodeID, marker)
+	if err != nil || comment == nil {
+		return "", "", err
+	}
+	if pr.minimized == nil {
+		pr.minimized = map[string]bool{}
+	}
+	pr.minimized[comment.Id] = comment.IsMinimized
+	return comment.Id, comment.Body, nil
+}
+
+func (pr *githubPullRequest) addComment(body string) error {
+	return pr.client.addComment(pr.nodeID, body)
+}
+
+func (pr *githubPullRequest) updateComment(id, body string) error {
+	return pr.client.updateComment(id, body)
+}
+
+func (pr *githubPullRequest) deleteComment(id string) error {
+	return pr.client.deleteComment(id)
+}
+
+func (pr *githubPullRequest) minimizeComment(id string, minimize bool) error {
+	if pr.minimized[id] == minimize {
+		return nil
+	}
+	return pr.client.minimizeComment(id, minimize)
+}
+
+func (pr *githubPullRequest) mention(handle string) string {
+	return handle
+}
+
+// addLabels adds the labels to the pull request, creating labels that don't exist in the repository yet.
+func (c *githubClient) addLabels(prNodeID string, labels []string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	labelIds := []string{}
+	for _, name := range labels {
+		id, err := c.labelId(prNodeID, name)
+		if err != nil {
+			return err
+		}
+		labelIds = append(labelIds, id)
+	}
+
+	fmt.Fprintf(verbose, "adding labels to pr %s: %s\n", prNodeID, strings.Join(labels, ", "))
+	return c.graphql(`
+		mutation AddLabels ($labelableId: ID!, $labelIds: [ID!]!) {
+			addLabelsToLabelable(input: {
+				labelableId: $labelableId
+				labelIds: $labelIds
+			}) {
+				clientMutationId
+			}
+		}`,
+		map[string]interface{}{
+			"labelableId": prNodeID,
+			"labelIds":    labelIds,
+		},
+		nil,
+	)
+}
+
+// labelId returns the node ID of the label with the given name in the pull request's repository,
+// creating the label if it doesn't exist.
+func (c *githubClient) labelId(prNodeID, name string) (string, error) {
+	data := struct {
+		Node struct {
+			Repository struct {
+				Id    string `json:"id"`
+				Label *struct {
+					Id string `json:"id"`
+				} `json:"label"`
+			} `json:"repository"`
+		} `json:"node"`
+	}{}
+	err := c.graphql(`
+		query GetLabel ($nodeId: ID!, $name: String!) {
+			node(id: $nodeId) {
+				... on PullRequest {
+					repository {
+						id
+						label(name: $name) {
+							id
+						}
+					}
+				}
+			}
+		}`,
+		map[string]interface{}{
+			"nodeId": prNodeID,
+			"name":   name,
+		},
+		&data,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if data.Node.Repository.Label != nil {
+		return data.Node.Repository.Label.Id, nil
+	}
+
+	fmt.Fprintf(verbose, "creating label %s\n", name)
+	created := struct {
+		CreateLabel struct {
+			Label struct {
+				Id string `json:"id"`
+			} `json:"label"`
+		} `json:"createLabel"`
+	}{}
+	err = c.graphql(`
+		mutation CreateLabel ($repositoryId: ID!, $name: String!, $color: String!) {
+			createLabel(input: {
+				repositoryId: $repositoryId
+				name: $name
+				color: $color
+			}) {
+				label {
+					id
+				}
+			}
+		}`,
+		map[string]interface{}{
+			"repositoryId": data.Node.Repository.Id,
+			"name":         name,
+			"color":        "ededed",
+		},
+		&created,
+	)
+	return created.CreateLabel.Label.Id, err
+}
+
+// requestReviews requests a review on the pull request from each of the
+// given user (@login) and team (@org/slug) handles.
+func (c *githubClient) requestReviews(prNodeID string, handles []string) error {
+	if len(handles) == 0 {
+		return nil
+	}
+
+	userIds := []string{}
+	teamIds := []string{}
+	requested := []string{}
+	for _, handle := range handles {
+		id, isTeam, err := c.resolveHandle(handle)
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			fmt.Fprintf(verbose, "not requesting review from %s because it could not be resolved\n", handle)
+			continue
+		}
+		if isTeam {
+			teamIds = append(teamIds, id)
+		} else {
+			userIds = append(userIds, id)
+		}
+		requested = append(requested, handle)
+	}
+
+	if len(requested) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(verbose, "requesting reviews on pr %s from %s\n", prNodeID, strings.Join(requested, ", "))
+	return c.graphql(`
+		mutation RequestReviews ($pullRequestId: ID!, $userIds: [ID!], $teamIds: [ID!]) {
+			requestReviews(input: {
+				pullRequestId: $pullRequestId
+				userIds: $userIds
+				teamIds: $teamIds
+				union: true
+			}) {
+				clientMutationId
+			}
+		}`,
+		map[string]interface{}{
+			"pullRequestId": prNodeID,
+			"userIds":       userIds,
+			"teamIds":       teamIds,
+		},
+		nil,
+	)
+}
+
+// resolveHandle returns the node ID of the user or team with the given handle.
+// An empty id is returned if no such user, organization or team exists.
+func (c *githubClient) resolveHandle(handle string) (id string, isTeam bool, err error) {
+	name := strings.TrimPrefix(handle, "@")
+	if i := strings.Index(name, "/"); i >= 0 {
+		data := struct {
+			Organization struct {
+				Team struct {
+					Id string `json:"id"`
+				} `json:"team"`
+			} `json:"organization"`
+		}{}
+		err := c.graphql(`
+			query ResolveTeam ($org: String!, $slug: String!) {
+				organization(login: $org) {
+					team(slug: $slug) {
+						id
+					}
+				}
+			}`,
+			map[string]interface{}{
+				"org":  name[:i],
+				"slug": name[i+1:],
+			},
+			&data,
+		)
+		if isNotFound(err) {
+			return "", true, nil
+		}
+		return data.Organization.Team.Id, true, err
+	}
+
+	data := struct {
+		User struct {
+			Id string `json:"id"`
+		} `json:"user"`
+	}{}
+	err = c.graphql(`
+		query ResolveUser ($login: String!) {
+			user(login: $login) {
+				id
+			}
+		}`,
+		map[string]interface{}{
+			"login": name,
+		},
+		&data,
+	)
+	if isNotFound(err) {
+		return "", false, nil
+	}
+	return data.User.Id, false, err
+}
+
+// graphqlError is the first error in the response to a GraphQL query.
+type graphqlError struct {
+	// errorType is the type of the error (e.g. NOT_FOUND).
+	errorType string
+	message   string
+	details   string
+}
+
+func (e *graphqlError) Error() string {
+	return fmt.Sprintf("graphql error: %s\nrequest:\n%s", e.message, e.details)
+}
+
+// isNotFound returns whether err is a GraphQL error for an object that doesn't exist,
+// like a user(login:) or organization(login:) with an unknown login.
+func isNotFound(err error) bool {
+	var ge *graphqlError
+	return errors.As(err, &ge) && ge.errorType == "NOT_FOUND"
+}
+
+func (c *githubClient) updateComment(id, body string) error {
+	fmt.Fprintf(verbose, "updating existing comment: %s\n", id)
+	return c.graphql(`
+		mutation UpdateComment ($id: ID!, $body: String!) {
+			updateIssueComment(input: {
+				id: $id
+				body: $body
+			}) {
+				clientMutationId
+			}
+		}`,
+		map[string]interface{}{
+			"id":   id,
+			"body": body,
+		},
+		nil,
+	)
+}
+
+func (c *githubClient) deleteComment(id string) error {
+	fmt.Fprintf(verbose, "deleting comment: %s\n", id)
+	return c.graphql(`
+		mutation DeleteComment ($id: ID!) {
+			deleteIssueComment(input: {
+				id: $id
+			}) {
+				clientMutationId
+			}
+		}`,
+		map[string]interface{}{
+			"id": id,
+		},
+		nil,
+	)
+}
+
+// minimizeComment minimizes the comment as outdated, or unminimizes it.
+func (c *githubClient) minimizeComment(id string, minimize bool) error {
+	if !minimize {
+		fmt.Fprintf(verbose, "unminimizing comment: %s\n", id)
+		return c.graphql(`
+			mutation UnminimizeComment ($id: ID!) {
+				unminimizeComment(input: {
+					subjectId: $id
+				}) {
+					clientMutationId
+				}
+			}`,
+			map[string]interface{}{
+				"id": id,
+			},
+			nil,
+		)
+	}
+
+	fmt.Fprintf(verbose, "minimizing comment: %s\n", id)
+	return c.graphql(`
+		mutation MinimizeComment ($id: ID!) {
+			minimizeComment(input: {
+				subjectId: $id
+				classifier: OUTDATED
+			}) {
+				clientMutationId
+			}
+		}`,
+		map[string]interface{}{
+			"id": id,
+		},
+		nil,
+	)
+}
+
+func (c *githubClient) addComment(subjectId, body string) error {
+	fmt.Fprintf(verbose, "adding comment to pr %s\n", subjectId)
+	return c.graphql(`
+		mutation AddComment ($subjectId: ID!, $body: String!) {
+			addComment(input: {
+				subjectId: $subjectId
+				body: $body
+			}) {
+				clientMutationId
+			}
+		}`,
+		map[string]interface{}{
+			"subjectId": subjectId,
+			"body":      body,
+		},
+		nil,
+	)
+}
+
+func (c *githubClient) commitCount(prNodeID string) (int, error) {
+	data := struct {
+		Node struct {
+			Commits struct {
+				TotalCount int `json:"totalCount"`
+			} `json:"commits"`
+		} `json:"node"`
+	}{}
+	err := c.graphql(`
+		query CommitCount ($nodeId: ID!) {
+			node(id: $nodeId) {
+				... on PullRequest {
+					commits {
+						totalCount
+					}
+				}
+			}
+		}`,
+		map[string]interface{}{
+			"nodeId": prNodeID,
+		},
+		&data,
+	)
+
+	return data.Node.Commits.TotalCount, err
+}
+
+// githubComment is a comment on a pull request.
+type githubComment struct {
+	Id          string `json:"id"`
+	Body        string `json:"body"`
+	IsMinimized bool   `json:"isMinimized"`
+}
+
+// existingComment returns the newest comment on the pull request that starts with marker,
+// or nil if there is none. Comments are searched newest first, one page at a time.
+func (c *githubClient) existingComment(prNodeID string, marker string) (*githubComment, error) {
+	var cursor *string
+	for {
+		data := struct {
+			Node struct {
+				Comments struct {
+					Nodes []struct {
+						githubComment
+						Author struct {
+							Login string `json:"login"`
+						} `json:"author"`
+					} `json:"nodes"`
+					PageInfo struct {
+						HasPreviousPage bool   `json:"hasPreviousPage"`
+						StartCursor     string `json:"startCursor"`
+					} `json:"pageInfo"`
+				} `json:"comments"`
+			} `json:"node"`
+		}{}
+		err := c.graphql(`
+			query GetPullRequestComments ($nodeId: ID!, $cursor: String) {
+				node(id: $nodeId) {
+					... on PullRequest {
+						comments(last: 100, before: $cursor) {
+							nodes {
+								id
+								author {
+									login
+								}
+								body
+								isMinimized
+							}
+							pageInfo {
+								hasPreviousPage
+								startCursor
+							}
+						}
+					}
+				}
+			}`,
+			map[string]interface{}{
+				"nodeId": prNodeID,
+				"cursor": cursor,
+			},
+			&data,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		comments := data.Node.Comments
+		for i := len(comments.Nodes) - 1; i >= 0; i-- {
+			comment := comments.Nodes[i].githubComment
+			if strings.HasPrefix(comment.Body, marker) {
+				return &comment, nil
+			}
+		}
+
+		if !comments.PageInfo.HasPreviousPage {
+			return nil, nil
+		}
+		cursor = &comments.PageInfo.StartCursor
+	}
+}
+
+func (c *githubClient) graphql(query string, variables map[string]interface{}, responseData interface{}) error {
+	waited := time.Duration(0)
+	for attempt := 0; ; attempt++ {
+		err := c.doGraphql(query, variables, responseData)
+		if err == nil {
+			return nil
+		}
+
+		// Errors end up in public logs, so make sure that they never contain the token.
+		err = redactError(err, c.token)
+
+		// Mutations are not idempotent, so they are never retried.
+		wait, retry := retryDelay(err, attempt)
+		if !retry || !isQuery(query) || waited+wait > c.retryBudget {
+			return err
+		}
+
+		fmt.Fprintf(verbose, "retrying in %s after error: %s\n", wait, err)
+		sleep(wait)
+		waited += wait
+	}
+}
+
+func (c *githubClient) doGraphql(query string, variables map[string]interface{}, responseData interface{}) error {
+	reqbody, err := json.Marshal(map[string]interface{}{
+		"query":     query,
+		"variables": variables,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal query %s and variables %s: %w", query, variables, err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewBuffer(reqbody))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "bearer "+c.token)
+	// The createLabel mutation is only available in the labels preview.
+	req.Header.Set("Accept", "application/vnd.github.bane-preview+json")
+
+	reqdump, err := dumpRequest(req)
+	if err != nil {
+		return fmt.Errorf("error dumping request: %w", err)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respdump, err := dumpResponse(resp)
+	if err != nil {
+		return fmt.Errorf("error dumping response: %w", err)
+	}
+
+	if resp.StatusCode != 200 {
+		details := fmt.Sprintf("%s\n\nrequest:\n%s", string(respdump), string(reqdump))
+		body, _ := ioutil.ReadAll(resp.Body)
+		if rl := rateLimit(resp, body); rl != nil {
+			rl.details = details
+			return rl
+		}
+		return &statusError{statusCode: resp.StatusCode, details: details}
+	}
+
+	response := struct {
+		Data   interface{}
+		Errors []struct {
+			Type    string   `json:"type"`
+			Path    []string `json:"path"`
+			Message string   `json:"message"`
+		} `json:"errors"`
+	}{
+		Data: responseData,
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("error decoding json response:\n%s\n%w", respdump, err)
+	}
+
+	if len(response.Errors) > 0 {
+		if response.Errors[0].Type == "RATE_LIMITED" {
+			return &rateLimitError{
+				retryAfter: retryAfter(resp.Header),
+				details:    fmt.Sprintf("%s\nrequest:\n%s", response.Errors[0].Message, reqdump),
+			}
+		}
+		return &graphqlError{errorType: response.Errors[0].Type, message: response.Errors[0].Message, details: string(reqdump)}
+	}
+
+	return nil
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExistingCommentId(t *testing.T) {
+	tests := []struct {
+		name     string
+		comments int
+		reports  []int
+		id       string
+		requests int
+	}{
+		{
+			name:     "no comments",
+			comments: 0,
+			id:       "",
+			requests: 1,
+		},
+		{
+			name:     "no report",
+			comments: 250,
+			id:       "",
+			requests: 3,
+		},
+		{
+			name:     "report on newest page",
+			comments: 250,
+			reports:  []int{240},
+			id:       "comment-240",
+			requests: 1,
+		},
+		{
+			name:     "report on oldest page",
+			comments: 250,
+			reports:  []int{5},
+			id:       "comment-5",
+			requests: 3,
+		},
+		{
+			name:     "newest report wins",
+			comments: 250,
+			reports:  []int{5, 120},
+			id:       "comment-120",
+			requests: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bodies := make([]string, test.comments)
+			for i := range bodies {
+				bodies[i] = fmt.Sprintf("comment %d", i)
+			}
+			for _, i := range test.reports {
+				bodies[i] = markdownCommentTitle("CODENOTIFY") + "report"
+			}
+
+			requests := 0
+			client := fakeGraphQL(t, func(query string, variables map[string]interface{}) interface{} {
+				requests++
+				if variables["nodeId"] != "pr" {
+					t.Errorf("expected nodeId pr; got %v", variables["nodeId"])
+				}
+				return commentsPage(bodies, nil, variables["cursor"])
+			})
+
+			comment, err := client.existingComment("pr", markdownCommentTitle("CODENOTIFY"))
+			if err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			id := ""
+			if comment != nil {
+				id = comment.Id
+			}
+			if id != test.id {
+				t.Errorf("expected id %q; got %q", test.id, id)
+			}
+			if requests != test.requests {
+				t.Errorf("expected %d requests; got %d", test.requests, requests)
+			}
+		})
+	}
+}
+
+// commentsPage returns the page of up to 100 comments that precede cursor
+// (the index of a comment in bodies), the way GitHub responds to comments(last: 100, before: $cursor).
+// minimized is the set of indexes of minimized comments.
+func commentsPage(bodies []string, minimized map[int]bool, cursor interface{}) interface{} {
+	end := len(bodies)
+	if c, ok := cursor.(string); ok {
+		end, _ = strconv.Atoi(c)
+	}
+	start := end - 100
+	if start < 0 {
+		start = 0
+	}
+
+	nodes := []map[string]interface{}{}
+	for i := start; i < end; i++ {
+		nodes = append(nodes, map[string]interface{}{
+			"id":          fmt.Sprintf("comment-%d", i),
+			"author":      map[string]interface{}{"login": "codenotify"},
+			"body":        bodies[i],
+			"isMinimized": minimized[i],
+		})
+	}
+
+	return map[string]interface{}{
+		"node": map[string]interface{}{
+			"comments": map[string]interface{}{
+				"nodes": nodes,
+				"pageInfo": map[string]interface{}{
+					"hasPreviousPage": start > 0,
+					"startCursor":     strconv.Itoa(start),
+				},
+			},
+		},
+	}
+}
+
+// fakeGraphQL starts a local GraphQL server for the duration of the test and
+// returns a client for it. The data returned by handler is sent as the response
+// to each request.
+func fakeGraphQL(t *testing.T, handler func(query string, variables map[string]interface{}) interface{}) *githubClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query     string                 `json:"query"`
+			Variables map[string]interface{} `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("unable to decode graphql request: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		response := map[string]interface{}{"data": handler(req.Query, req.Variables)}
+		if e, ok := response["data"].(fakeGraphQLError); ok {
+			response = map[string]interface{}{"data": nil, "errors": []fakeGraphQLError{e}}
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Errorf("unable to encode graphql response: %s", err)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return newTestGitHubClient(server.URL)
+}
+
+// fakeGraphQLError can be returned by the handler of fakeGraphQL to respond with an error instead of data.
+type fakeGraphQLError struct {
+	Type    string   `json:"type"`
+	Path    []string `json:"path"`
+	Message string   `json:"message"`
+}
+
+// newTestGitHubClient returns a client for the GraphQL endpoint at url.
+func newTestGitHubClient(url string) *githubClient {
+	return &githubClient{
+		url:         url,
+		token:       "test-token",
+		http:        &http.Client{},
+		retryBudget: time.Minute,
+	}
+}
+
+func TestNewGitHubClientFromEnv(t *testing.T) {
+	setenv(t, "GITHUB_GRAPHQL_URL", "")
+	setenv(t, "GITHUB_TOKEN", "")
+	if _, err := newGitHubClientFromEnv(); err == nil || err.Error() != "GITHUB_GRAPHQL_URL is not set" {
+		t.Errorf("expected GITHUB_GRAPHQL_URL error; got %v", err)
+	}
+
+	setenv(t, "GITHUB_GRAPHQL_URL", "https://api.github.com/graphql")
+	if _, err := newGitHubClientFromEnv(); err == nil || err.Error() != "GITHUB_TOKEN is not set" {
+		t.Errorf("expected GITHUB_TOKEN error; got %v", err)
+	}
+
+	setenv(t, "GITHUB_TOKEN", "token")
+	client, err := newGitHubClientFromEnv()
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if client.url != "https://api.github.com/graphql" || client.token != "token" {
+		t.Errorf("unexpected client %+v", client)
+	}
+}
+
+func TestCommentOnGitHubPullRequest(t *testing.T) {
+	opts := options{
+		filename: "CODENOTIFY",
+		format:   "markdown",
+		baseRef:  "a",
+		headRef:  "b",
+		comment:  true,
+	}
+	report := markdownReport("CODENOTIFY", "a", "b")
+
+	tests := []struct {
+		name       string
+		opts       func(o *options)
+		comments   []string
+		minimized  map[int]bool
+		unknown    map[string]bool
+		notifs     map[string][]string
+		operations []string
+		comments2  []string
+		reviewers  []string
+	}{
+		{
+			name:       "create",
+			comments:   []string{"lgtm"},
+			notifs:     map[string][]string{"@go": {"file.go"}},
+			operations: []string{"GetPullRequestComments", "AddComment"},
+			comments2:  []string{"lgtm", report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))},
+		},
+		{
+			name:       "update",
+			comments:   []string{"lgtm", report("No notifications."), "thanks"},
+			notifs:     map[string][]string{"@go": {"file.go"}},
+			operations: []string{"GetPullRequestComments", "UpdateComment"},
+			comments2:  []string{"lgtm", report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go")), "thanks"},
+		},
+		{
+			name:       "update to no notifications",
+			comments:   []string{report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))},
+			notifs:     map[string][]string{},
+			operations: []string{"GetPullRequestComments", "UpdateComment"},
+			comments2:  []string{report("No notifications.", notifiedList("@go"))},
+		},
+		{
+			name:       "delete when no notifications",
+			opts:       func(o *options) { o.staleReport = staleDelete },
+			comments:   []string{"lgtm", report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go")), "thanks"},
+			notifs:     map[string][]string{},
+			operations: []string{"GetPullRequestComments", "DeleteComment"},
+			comments2:  []string{"lgtm", "thanks"},
+		},
+		{
+			name:       "minimize when no notifications",
+			opts:       func(o *options) { o.staleReport = staleMinimize },
+			comments:   []string{report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))},
+			notifs:     map[string][]string{},
+			operations: []string{"GetPullRequestComments", "UpdateComment", "MinimizeComment"},
+			comments2:  []string{report("No notifications.", notifiedList("@go"))},
+		},
+		{
+			name:       "unminimize when notifications return",
+			opts:       func(o *options) { o.staleReport = staleMinimize },
+			comments:   []string{report("No notifications.", notifiedList("@go"))},
+			minimized:  map[int]bool{0: true},
+			notifs:     map[string][]string{"@go": {"file.go"}},
+			operations: []string{"GetPullRequestComments", "UpdateComment", "UnminimizeComment"},
+			comments2:  []string{report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))},
+		},
+		{
+			name:       "keep minimized",
+			opts:       func(o *options) { o.staleReport = staleMinimize },
+			comments:   []string{report("No notifications.", notifiedList("@go"))},
+			minimized:  map[int]bool{0: true},
+			notifs:     map[string][]string{},
+			operations: []string{"GetPullRequestComments", "UpdateComment"},
+			comments2:  []string{report("No notifications.", notifiedList("@go"))},
+		},
+		{
+			name:       "strike through unsubscribed",
+			opts:       func(o *options) { o.staleReport = staleStrikethrough },
+			comments:   []string{report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", "| @js | file.js |", notifiedList("@go", "@js"))},
+			notifs:     map[string][]string{"@js": {"file.js"}},
+			operations: []string{"GetPullRequestComments", "UpdateComment"},
+			comments2:  []string{report("| Notify | File(s) |", "|-|-|", "| @js | file.js |", "| ~~`@go`~~ | no longer subscribed |", notifiedList("@go", "@js"))},
+		},
+		{
+			name:       "strike through all",
+			opts:       func(o *options) { o.staleReport = staleStrikethrough },
+			comments:   []string{report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))},
+			notifs:     map[string][]string{},
+			operations: []string{"GetPullRequestComments", "UpdateComment"},
+			comments2:  []string{report("| Notify | File(s) |", "|-|-|", "| ~~`@go`~~ | no longer subscribed |", notifiedList("@go"))},
+		},
+		{
+			name:       "skip",
+			comments:   []string{"lgtm"},
+			notifs:     map[string][]string{},
+			operations: []string{"GetPullRequestComments"},
+			comments2:  []string{"lgtm"},
+		},
+		{
+			name:       "request reviews",
+			notifs:     map[string][]string{"@go:review": {"file.go"}, "@org/js:review": {"file.js"}, "@md": {"file.md"}},
+			operations: []string{"GetPullRequestComments", "AddComment", "ResolveUser", "ResolveTeam", "RequestReviews"},
+			comments2:  []string{report("| Notify | File(s) |", "|-|-|", "| @go (review) | file.go |", "| @md | file.md |", "| @org/js (review) | file.js |", notifiedList("@go", "@md", "@org/js"))},
+			reviewers:  []string{"user:go", "team:org/js"},
+		},
+		{
+			name:       "request reviews from unknown users and organizations",
+			opts:       func(o *options) { o.comment = false },
+			unknown:    map[string]bool{"typo": true, "typo-org": true, "alice@example.com": true},
+			notifs:     map[string][]string{"@go:review": {"file.go"}, "@typo:review": {"file.go"}, "@typo-org/js:review": {"file.js"}, "alice@example.com:review": {"file.md"}},
+			operations: []string{"ResolveUser", "ResolveUser", "ResolveTeam", "ResolveUser", "RequestReviews"},
+			comments2:  []string{},
+			reviewers:  []string{"user:go"},
+		},
+		{
+			name:       "request reviews only from unknown users",
+			opts:       func(o *options) { o.comment = false },
+			unknown:    map[string]bool{"typo": true},
+			notifs:     map[string][]string{"@typo:review": {"file.go"}},
+			operations: []string{"ResolveUser"},
+			comments2:  []string{},
+		},
+		{
+			name:       "request reviews without comment",
+			opts:       func(o *options) { o.comment = false },
+			notifs:     map[string][]string{"@go:review": {"file.go"}},
+			operations: []string{"ResolveUser", "RequestReviews"},
+			comments2:  []string{},
+			reviewers:  []string{"user:go"},
+		},
+		{
+			name:       "threshold exceeded",
+			opts:       func(o *options) { o.subscriberThreshold = 1 },
+			notifs:     map[string][]string{"@go:review": {"file.go"}, "@js:review": {"file.js"}},
+			operations: []string{"GetPullRequestComments", "AddComment"},
+			comments2:  []string{joinLines([]string{"Not notifying subscribers because the number of notifying subscribers (2) has exceeded the threshold (1).", notifiedList()})},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := opts
+			if test.opts != nil {
+				test.opts(&o)
+			}
+
+			gh := &fakeGitHub{comments: append([]string{}, test.comments...), minimized: test.minimized, unknown: test.unknown}
+			client := fakeGraphQL(t, gh.handle)
+
+			if err := commentOnGitHubPullRequest(&o, client, "pr")(test.notifs); err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+
+			if !reflect.DeepEqual(test.operations, gh.operations) {
+				t.Errorf("expected operations %v; got %v", test.operations, gh.operations)
+			}
+			if test.comments2 == nil {
+				test.comments2 = []string{}
+			}
+			if !reflect.DeepEqual(test.comments2, gh.comments) {
+				t.Errorf("expected comments:\n%q\ngot:\n%q", test.comments2, gh.comments)
+			}
+			if !reflect.DeepEqual(test.reviewers, gh.reviewers) {
+				t.Errorf("expected reviewers %v; got %v", test.reviewers, gh.reviewers)
+			}
+		})
+	}
+}
+
+func TestCommitCount(t *testing.T) {
+	gh := &fakeGitHub{commits: 42}
+	client := fakeGraphQL(t, gh.handle)
+	count, err := client.commitCount("pr")
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if count != 42 {
+		t.Errorf("expected 42 commits; got %d", count)
+	}
+}
+
+func TestAddLabels(t *testing.T) {
+	gh := &fakeGitHub{labels: map[string]string{"database": "label-database"}}
+	client := fakeGraphQL(t, gh.handle)
+	if err := client.addLabels("pr", []string{"database", "docs"}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+
+	expectedOperations := []string{"GetLabel", "GetLabel", "CreateLabel", "AddLabels"}
+	if !reflect.DeepEqual(expectedOperations, gh.operations) {
+		t.Errorf("expected operations %v; got %v", expectedOperations, gh.operations)
+	}
+	expectedLabels := []string{"label-database", "label-docs"}
+	if !reflect.DeepEqual(expectedLabels, gh.added) {
+		t.Errorf("expected labels %v; got %v", expectedLabels, gh.added)
+	}
+}
+
+var operationName = regexp.MustCompile(`(?:query|mutation)\s+(\w+)`)
+
+// fakeGitHub is an in-memory stand-in for the parts of the GitHub GraphQL API
+// that codenotify uses. Its handle method can be passed to fakeGraphQL.
+type fakeGitHub struct {
+	// comments are the bodies of the comments on the pull request, oldest first.
+	comments []string
+	// minimized is the set of indexes of minimized comments.
+	minimized map[int]bool
+	// commits is the number of commits in the pull request.
+	commits int
+	// labels maps the names of labels in the repository to their ids.
+	labels map[string]string
+	// unknown is the set of user and organization logins that don't exist.
+	unknown map[string]bool
+
+	// operations are the names of the operations that were executed, in order.
+	operations []string
+	// reviewers are the users and teams that reviews were requested from.
+	reviewers []string
+	// added are the ids of labels added to the pull request.
+	added []string
+}
+
+func (f *fakeGitHub) handle(query string, variables map[string]interface{}) interface{} {
+	op := operationName.FindStringSubmatch(query)[1]
+	f.operations = append(f.operations, op)
+
+	switch op {
+	case "GetPullRequestComments":
+		return commentsPage(f.comments, f.minimized, variables["cursor"])
+	case "AddComment":
+		f.comments = append(f.comments, variables["body"].(string))
+	case "UpdateComment":
+		i, _ := strconv.Atoi(strings.TrimPrefix(variables["id"].(string), "comment-"))
+		f.comments[i] = variables["body"].(string)
+	case "DeleteComment":
+		i, _ := strconv.Atoi(strings.TrimPrefix(variables["id"].(string), "comment-"))
+		f.comments = append(f.comments[:i], f.comments[i+1:]...)
+	case "MinimizeComment", "UnminimizeComment":
+		i, _ := strconv.Atoi(strings.TrimPrefix(variables["id"].(string), "comment-"))
+		if f.minimized == nil {
+			f.minimized = map[int]bool{}
+		}
+		f.minimized[i] = op == "MinimizeComment"
+	case "CommitCount":
+		return map[string]interface{}{
+			"node": map[string]interface{}{
+				"commits": map[string]interface{}{"totalCount": f.commits},
+			},
+		}
+	case "ResolveUser":
+		if login := variables["login"].(string); f.unknown[login] {
+			return fakeGraphQLError{Type: "NOT_FOUND", Path: []string{"user"}, Message: fmt.Sprintf("Could not resolve to a User with the login of '%s'.", login)}
+		}
+		return map[string]interface{}{
+			"user": map[string]interface{}{"id": "user:" + variables["login"].(string)},
+		}
+	case "ResolveTeam":
+		if org := variables["org"].(string); f.unknown[org] {
+			return fakeGraphQLError{Type: "NOT_FOUND", Path: []string{"organization"}, Message: fmt.Sprintf("Could not resolve to an Organization with the login of '%s'.", org)}
+		}
+		return map[string]interface{}{
+			"organization": map[string]interface{}{
+				"team": map[string]interface{}{"id": fmt.Sprintf("team:%s/%s", variables["org"], variables["slug"])},
+			},
+		}
+	case "RequestReviews":
+		for _, key := range []string{"userIds", "teamIds"} {
+			for _, id := range variables[key].([]interface{}) {
+				f.reviewers = append(f.reviewers, id.(string))
+			}
+		}
+	case "GetLabel":
+		var label interface{}
+		if id, ok := f.labels[variables["name"].(string)]; ok {
+			label = map[string]interface{}{"id": id}
+		}
+		return map[string]interface{}{
+			"node": map[string]interface{}{
+				"repository": map[string]interface{}{"id": "repo", "label": label},
+			},
+		}
+	case "CreateLabel":
+		id := "label-" + variables["name"].(string)
+		return map[string]interface{}{
+			"createLabel": map[string]interface{}{
+				"label": map[string]interface{}{"id": id},
+			},
+		}
+	case "AddLabels":
+		for _, id := range variables["labelIds"].([]interface{}) {
+			f.added = append(f.added, id.(string))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// githubApp authenticates to GitHub as a GitHub App installation.
+// Unlike the default GITHUB_TOKEN, an installation token can mention teams.
+type githubApp struct {
+	// apiURL is the REST API endpoint (e.g. https://api.github.com).
+	apiURL string
+	// appID is the ID of the GitHub App.
+	appID string
+	// key is the private key of the GitHub App.
+	key *rsa.PrivateKey
+	// http sends requests to the API.
+	http *http.Client
+}
+
+// parsePrivateKey parses a PEM encoded RSA private key in either PKCS #1 or PKCS #8 form,
+// as downloaded from the GitHub App settings page.
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in GitHub App private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse GitHub App private key: %w", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("GitHub App private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// jwt returns a JSON Web Token that authenticates as the GitHub App.
+func (a *githubApp) jwt() (string, error) {
+	// Backdate the token to allow for clock drift, and keep it within GitHub's 10 minute maximum lifetime.
+	issuedAt := now().Add(-time.Minute)
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": issuedAt.Unix(),
+		"exp": issuedAt.Add(10 * time.Minute).Unix(),
+		"iss": a.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign GitHub App JWT: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// installationToken returns an installation access token for the installation of the GitHub App
+// on the repository (owner/name). If installationID is empty, it is looked up.
+func (a *githubApp) installationToken(repository, installationID string) (string, error) {
+	jwt, err := a.jwt()
+	if err != nil {
+		return "", err
+	}
+
+	if installationID == "" {
+		installation := struct {
+			ID int64 `json:"id"`
+		}{}
+		if err := a.rest(jwt, http.MethodGet, "/repos/"+repository+"/installation", &installation); err != nil {
+			return "", redactError(fmt.Errorf("unable to find GitHub App installation for %s: %w", repository, err), jwt)
+		}
+		installationID = strconv.FormatInt(installation.ID, 10)
+	}
+
+	token := struct {
+		Token string `json:"token"`
+	}{}
+	if err := a.rest(jwt, http.MethodPost, "/app/installations/"+installationID+"/access_tokens", &token); err != nil {
+		return "", redactError(fmt.Errorf("unable to create GitHub App installation token: %w", err), jwt)
+	}
+	if token.Token == "" {
+		return "", errors.New("GitHub did not return a GitHub App installation token")
+	}
+
+	fmt.Fprintf(verbose, "authenticated as installation %s of GitHub App %s\n", installationID, a.appID)
+	return token.Token, nil
+}
+
+// rest sends a request to the GitHub REST API authenticated with the JWT and decodes the response into responseData.
+func (a *githubApp) rest(jwt, method, path string, responseData interface{}) error {
+	req, err := http.NewRequest(method, a.apiURL+path, bytes.NewReader(nil))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respdump, err := dumpResponse(resp)
+		if err != nil {
+			return fmt.Errorf("error dumping response: %w", err)
+		}
+		return &statusError{statusCode: resp.StatusCode, details: string(respdump)}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(responseData); err != nil {
+		return fmt.Errorf("error decoding json response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGitHubAppInstallationToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeNow := time.Unix(1600000000, 0)
+	waited := time.Duration(0)
+	fakeTime(t, fakeNow, &waited)
+
+	tests := []struct {
+		name           string
+		installationID string
+		requests       []string
+	}{
+		{
+			name:           "known installation",
+			installationID: "123",
+			requests:       []string{"POST /app/installations/123/access_tokens"},
+		},
+		{
+			name:     "installation lookup",
+			requests: []string{"GET /repos/octo/repo/installation", "POST /app/installations/123/access_tokens"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := []string{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				if err := verifyJWT(&key.PublicKey, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), fakeNow); err != nil {
+					t.Errorf("invalid JWT: %s", err)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				switch r.Method + " " + r.URL.Path {
+				case "GET /repos/octo/repo/installation":
+					fmt.Fprint(w, `{"id": 123}`)
+				case "POST /app/installations/123/access_tokens":
+					w.WriteHeader(http.StatusCreated)
+					fmt.Fprint(w, `{"token": "ghs_installation", "expires_at": "2020-09-13T13:26:40Z"}`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			app := &githubApp{apiURL: server.URL, appID: "42", key: key, http: &http.Client{}}
+			token, err := app.installationToken("octo/repo", test.installationID)
+			if err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if token != "ghs_installation" {
+				t.Errorf("expected token ghs_installation; got %s", token)
+			}
+			if strings.Join(requests, "\n") != strings.Join(test.requests, "\n") {
+				t.Errorf("expected requests %q; got %q", test.requests, requests)
+			}
+		})
+	}
+}
+
+func TestGitHubAppErrorsNeverContainJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwts := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		jwts = append(jwts, jwt)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"message": "bad JWT %s"}`, jwt)
+	}))
+	defer server.Close()
+
+	app := &githubApp{apiURL: server.URL, appID: "42", key: key, http: &http.Client{}}
+	_, err = app.installationToken("octo/repo", "")
+	if err == nil {
+		t.Fatal("expected error; got nil")
+	}
+	for _, jwt := range jwts {
+		if strings.Contains(err.Error(), jwt) {
+			t.Errorf("error contains JWT:\n%s", err)
+		}
+	}
+}
+
+func TestNewGitHubClientFromEnvWithApp(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyJWT(&key.PublicKey, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), time.Now()); err != nil {
+			t.Errorf("invalid JWT: %s", err)
+		}
+		fmt.Fprint(w, `{"token": "ghs_installation"}`)
+	}))
+	defer server.Close()
+
+	setenv(t, "GITHUB_GRAPHQL_URL", server.URL+"/graphql")
+	setenv(t, "GITHUB_API_URL", server.URL)
+	setenv(t, "GITHUB_REPOSITORY", "octo/repo")
+	setenv(t, "GITHUB_TOKEN", "")
+	setenv(t, "INPUT_APP-ID", "42")
+	setenv(t, "INPUT_APP-INSTALLATION-ID", "123")
+	setenv(t, "INPUT_APP-PRIVATE-KEY", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})))
+
+	client, err := newGitHubClientFromEnv()
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if client.token != "ghs_installation" {
+		t.Errorf("expected installation token; got %s", client.token)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, block := range []*pem.Block{
+		{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		{Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		parsed, err := parsePrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			t.Errorf("%s: expected nil error; got %s", block.Type, err)
+			continue
+		}
+		if !parsed.Equal(key) {
+			t.Errorf("%s: parsed key does not equal original key", block.Type)
+		}
+	}
+
+	if _, err := parsePrivateKey([]byte("not a key")); err == nil {
+		t.Error("expected error for invalid key; got nil")
+	}
+}
+
+// verifyJWT verifies that jwt is a valid GitHub App JWT signed by key at time now.
+func verifyJWT(key *rsa.PublicKey, jwt string, now time.Time) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("expected 3 parts; got %d", len(parts))
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return err
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+	if string(header) != `{"alg":"RS256","typ":"JWT"}` {
+		return fmt.Errorf("unexpected header %s", header)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	claims := struct {
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+		Iss string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+	if claims.Iss != "42" {
+		return fmt.Errorf("expected issuer 42; got %s", claims.Iss)
+	}
+	if claims.Iat > now.Unix() || claims.Exp <= now.Unix() {
+		return fmt.Errorf("token is not valid at %d: %+v", now.Unix(), claims)
+	}
+	if claims.Exp-claims.Iat > 600 {
+		return fmt.Errorf("token lifetime exceeds 10 minutes: %+v", claims)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// newGitLabClient returns a client for the GitLab REST API at apiURL (e.g. https://gitlab.com/api/v4)
+// that authenticates with a personal, project or group access token with the api scope.
+func newGitLabClient(apiURL, token string) *restClient {
+	return &restClient{
+		url:    apiURL,
+		header: http.Header{"Private-Token": {token}},
+		http:   &http.Client{},
+	}
+}
+
+// gitlabMergeRequest implements commenter for a GitLab merge request.
+type gitlabMergeRequest struct {
+	client    *restClient
+	projectID string
+	iid       string
+}
+
+func (mr *gitlabMergeRequest) path() string {
+	return "/projects/" + url.PathEscape(mr.projectID) + "/merge_requests/" + url.PathEscape(mr.iid)
+}
+
+// gitlabOptions returns options for running in a GitLab CI merge request pipeline.
+// See https://docs.gitlab.com/ee/ci/variables/predefined_variables.html
+func gitlabOptions() (*options, error) {
+	token := os.Getenv("CODENOTIFY_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("env var CODENOTIFY_TOKEN not set")
+	}
+
+	mr := &gitlabMergeRequest{
+		client:    newGitLabClient(os.Getenv("CI_API_V4_URL"), token),
+		projectID: os.Getenv("CI_MERGE_REQUEST_PROJECT_ID"),
+		iid:       os.Getenv("CI_MERGE_REQUEST_IID"),
+	}
+
+	info, err := mr.info()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Draft {
+		fmt.Fprintln(verbose, "Not sending notifications for draft merge request.")
+		return nil, nil
+	}
+
+	commitCount, err := mr.commitCount()
+	if err != nil {
+		return nil, err
+	}
+
+	cwd := os.Getenv("CI_PROJECT_DIR")
+	if err := deepen(cwd, commitCount); err != nil {
+		return nil, err
+	}
+
+	filename, subscriberThreshold := ciSettings()
+	o := &options{
+		cwd:                 cwd,
+		format:              "markdown",
+		filename:            filename,
+		subscriberThreshold: subscriberThreshold,
+		baseRef:             os.Getenv("CI_MERGE_REQUEST_DIFF_BASE_SHA"),
+		headRef:             os.Getenv("CI_COMMIT_SHA"),
+		author:              "@" + info.Author.Username,
+		url:                 info.WebURL,
+	}
+	if err := o.applyEnv(ciVariables, false); err != nil {
+		return nil, err
+	}
+	o.print = commentOn(o, mr)
+	if err := addSinksFromEnv(o, ciVariables); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// gitlabMergeRequestInfo is the subset of a merge request's attributes that codenotify uses.
+type gitlabMergeRequestInfo struct {
+	Draft  bool   `json:"draft"`
+	WebURL string `json:"web_url"`
+	Author struct {
+		Username string `json:"username"`
+	} `json:"author"`
+}
+
+func (mr *gitlabMergeRequest) info() (*gitlabMergeRequestInfo, error) {
+	info := &gitlabMergeRequestInfo{}
+	_, err := mr.client.do(http.MethodGet, mr.path(), nil, info)
+	return info, err
+}
+
+// commitCount returns the number of commits in the merge request.
+func (mr *gitlabMergeRequest) commitCount() (int, error) {
+	commits := []struct{}{}
+	header, err := mr.client.do(http.MethodGet, mr.path()+"/commits?per_page=1", nil, &commits)
+	if err != nil {
+		return 0, err
+	}
+
+	total, err := strconv.Atoi(header.Get("X-Total"))
+	if err != nil {
+		return 0, fmt.Errorf("unable to count commits in merge request %s: invalid X-Total header %q", mr.iid, header.Get("X-Total"))
+	}
+	return total, nil
+}
+
+// existingComment searches notes newest first, one page at a time.
+func (mr *gitlabMergeRequest) existingComment(marker string) (string, string, error) {
+	page := "1"
+	for page != "" {
+		notes := []struct {
+			ID   int    `json:"id"`
+			Body string `json:"body"`
+		}{}
+		header, err := mr.client.do(http.MethodGet, mr.path()+"/notes?sort=desc&order_by=created_at&per_page=100&page="+page, nil, &notes)
+		if err != nil {
+			return "", "", err
+		}
+
+		for _, note := range notes {
+			if strings.HasPrefix(note.Body, marker) {
+				return strconv.Itoa(note.ID), note.Body, nil
+			}
+		}
+
+		page = header.Get("X-Next-Page")
+	}
+	return "", "", nil
+}
+
+func (mr *gitlabMergeRequest) addComment(body string) error {
+	fmt.Fprintf(verbose, "adding note to merge request %s\n", mr.iid)
+	_, err := mr.client.do(http.MethodPost, mr.path()+"/notes", map[string]string{"body": body}, nil)
+	return err
+}
+
+func (mr *gitlabMergeRequest) updateComment(id, body string) error {
+	fmt.Fprintf(verbose, "updating existing note: %s\n", id)
+	_, err := mr.client.do(http.MethodPut, mr.path()+"/notes/"+url.PathEscape(id), map[string]string{"body": body}, nil)
+	return err
+}
+
+func (mr *gitlabMergeRequest) deleteComment(id string) error {
+	fmt.Fprintf(verbose, "deleting note: %s\n", id)
+	_, err := mr.client.do(http.MethodDelete, mr.path()+"/notes/"+url.PathEscape(id), nil, nil)
+	return err
+}
+
+func (mr *gitlabMergeRequest) mention(handle string) string {
+	return handle
+}
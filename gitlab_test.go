@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCommentOnGitLabMergeRequest(t *testing.T) {
+	report := markdownReport("CODENOTIFY", "a", "b")
+
+	runCommentTests(t, []commentTest{
+		{
+			name:      "create",
+			comments:  []string{"lgtm"},
+			notifs:    map[string][]string{"@go": {"file.go"}},
+			requests:  []string{"GET notes page 1", "POST notes"},
+			comments2: []string{"lgtm", report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))},
+		},
+		{
+			name:      "update",
+			comments:  []string{report("No notifications."), "lgtm"},
+			notifs:    map[string][]string{"@go": {"file.go"}},
+			requests:  []string{"GET notes page 1", "PUT notes/1"},
+			comments2: []string{report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go")), "lgtm"},
+		},
+		{
+			name:      "update on older page",
+			comments:  append([]string{report("No notifications.")}, fillerComments(150)...),
+			notifs:    map[string][]string{"@go": {"file.go"}},
+			requests:  []string{"GET notes page 1", "GET notes page 2", "PUT notes/1"},
+			comments2: append([]string{report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))}, fillerComments(150)...),
+		},
+		{
+			name:     "follow-up for new subscribers",
+			comments: []string{report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))},
+			notifs:   map[string][]string{"@go": {"file.go"}, "@js:review": {"file.js"}, "@md:silent": {"file.md"}},
+			requests: []string{"GET notes page 1", "POST notes", "PUT notes/1"},
+			comments2: []string{
+				report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", "| @js (review) | file.js |", "| `@md` | file.md |", notifiedList("@go", "@js")),
+				"[Codenotify](https://github.com/sourcegraph/codenotify): Notifying new subscribers in CODENOTIFY files for diff a...b: @js (review).\n",
+			},
+		},
+		{
+			name:      "no follow-up for notified subscribers",
+			comments:  []string{report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go", "@js"))},
+			notifs:    map[string][]string{"@js": {"file.js"}},
+			requests:  []string{"GET notes page 1", "PUT notes/1"},
+			comments2: []string{report("| Notify | File(s) |", "|-|-|", "| @js | file.js |", notifiedList("@go", "@js"))},
+		},
+		{
+			name:      "delete",
+			opts:      func(o *options) { o.staleReport = staleDelete },
+			comments:  []string{"lgtm", report("| Notify | File(s) |", "|-|-|", "| @go | file.go |", notifiedList("@go"))},
+			notifs:    map[string][]string{},
+			requests:  []string{"GET notes page 1", "DELETE notes/2"},
+			comments2: []string{"lgtm"},
+		},
+		{
+			name:      "skip",
+			comments:  fillerComments(150),
+			notifs:    map[string][]string{},
+			requests:  []string{"GET notes page 1", "GET notes page 2"},
+			comments2: fillerComments(150),
+		},
+	}, func(t *testing.T, f *fakeComments) commenter {
+		url := serve(t, &fakeGitLab{fakeComments: f})
+		return &gitlabMergeRequest{client: newGitLabClient(url, "glpat-test"), projectID: "7", iid: "42"}
+	})
+}
+
+func TestGitLabMergeRequest(t *testing.T) {
+	url := serve(t, &fakeGitLab{fakeComments: &fakeComments{t: t}, commits: 3, author: "alice", draft: true})
+	mr := &gitlabMergeRequest{client: newGitLabClient(url, "glpat-test"), projectID: "7", iid: "42"}
+
+	info, err := mr.info()
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if info.Author.Username != "alice" || !info.Draft {
+		t.Errorf("unexpected merge request %+v", info)
+	}
+
+	count, err := mr.commitCount()
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 commits; got %d", count)
+	}
+}
+
+func TestGitLabErrorsNeverContainToken(t *testing.T) {
+	url := serve(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, `{"message": "401 Unauthorized %s"}`, r.Header.Get("Private-Token"))
+	}))
+
+	mr := &gitlabMergeRequest{client: newGitLabClient(url, "glpat-secret"), projectID: "7", iid: "42"}
+	_, _, err := mr.existingComment(markdownCommentTitle("CODENOTIFY"))
+	if err == nil {
+		t.Fatal("expected error; got nil")
+	}
+	if strings.Contains(err.Error(), "glpat-secret") {
+		t.Errorf("error contains token:\n%s", err)
+	}
+}
+
+// fakeGitLab is an in-memory stand-in for the parts of the GitLab REST API
+// that codenotify uses, for merge request 42 of project 7. Its comments are notes.
+type fakeGitLab struct {
+	*fakeComments
+	// commits is the number of commits in the merge request.
+	commits int
+	// author is the username of the author of the merge request.
+	author string
+	// draft is true if the merge request is a draft.
+	draft bool
+}
+
+func (f *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Private-Token") != "glpat-test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	const prefix = "/projects/7/merge_requests/42"
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	id := strings.TrimPrefix(path, "/notes/")
+	switch {
+	case r.Method == http.MethodGet && path == "":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"draft":  f.draft,
+			"author": map[string]interface{}{"username": f.author},
+		})
+	case r.Method == http.MethodGet && path == "/commits":
+		w.Header().Set("X-Total", strconv.Itoa(f.commits))
+		fmt.Fprint(w, "[{}]")
+	case r.Method == http.MethodGet && path == "/notes":
+		query := r.URL.Query()
+		if query.Get("sort") != "desc" || query.Get("order_by") != "created_at" {
+			f.t.Errorf("expected notes sorted newest first; got %s", r.URL.RawQuery)
+		}
+		page, _ := strconv.Atoi(query.Get("page"))
+		perPage, _ := strconv.Atoi(query.Get("per_page"))
+		f.request("GET notes page %d", page)
+
+		notes := []map[string]interface{}{}
+		for i := len(f.comments) - 1 - (page-1)*perPage; i >= 0 && len(notes) < perPage; i-- {
+			notes = append(notes, map[string]interface{}{"id": i + 1, "body": f.comments[i]})
+		}
+		if page*perPage < len(f.comments) {
+			w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+		}
+		json.NewEncoder(w).Encode(notes)
+	case r.Method == http.MethodPost && path == "/notes":
+		f.request("POST notes")
+		f.add(f.body(r))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodPut && id != path:
+		f.request("PUT notes/%s", id)
+		f.update(id, f.body(r))
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodDelete && id != path:
+		f.request("DELETE notes/%s", id)
+		f.delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.unexpected(w, r)
+	}
+}
+
+// body returns the body of the note in the request.
+func (f *fakeGitLab) body(r *http.Request) string {
+	body := struct {
+		Body string `json:"body"`
+	}{}
+	f.decodeBody(r, &body)
+	return body.Body
+}
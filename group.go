@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// groupFromEnv sets whether o groups files from the boolean env var name, if it is set.
+func (o *options) groupFromEnv(name string) error {
+	if v := os.Getenv(name); v != "" {
+		group, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", name, v)
+		}
+		o.group = group
+	}
+	return nil
+}
+
+// groupNotifications returns notifs with the files of each subscriber grouped by directory.
+func groupNotifications(notifs map[string][]string) map[string][]string {
+	grouped := make(map[string][]string, len(notifs))
+	for sub, files := range notifs {
+		grouped[sub] = groupByDirectory(files)
+	}
+	return grouped
+}
+
+// groupByDirectory groups files by their top-level directory with groupFiles, and replaces each group of more
+// than one file with the longest common directory of the group, in the notation of rollupFiles
+// (e.g. "client/web/ (143 files)"). Files in the root directory are not grouped. Groups are in the order of their first file.
+func groupByDirectory(files []string) []string {
+	groups := groupFiles(files, 1)
+	entries := make([]string, 0, len(groups))
+	for _, g := range groups {
+		if len(g.files) > 1 {
+			g.dir = commonDirectory(g.files) + "/"
+		}
+		entries = append(entries, g.String())
+	}
+	return entries
+}
+
+// commonDirectory returns the longest directory that contains all of the files.
+func commonDirectory(files []string) string {
+	dir := strings.Split(files[0], "/")
+	dir = dir[:len(dir)-1]
+	for _, file := range files[1:] {
+		parts := strings.Split(file, "/")
+		parts = parts[:len(parts)-1]
+		n := 0
+		for n < len(dir) && n < len(parts) && dir[n] == parts[n] {
+			n++
+		}
+		dir = dir[:n]
+	}
+	return strings.Join(dir, "/")
+}
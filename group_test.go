@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGroupByDirectory(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		entries []string
+	}{
+		{
+			name:    "single files",
+			files:   []string{"README.md", "client/web/index.ts"},
+			entries: []string{"README.md", "client/web/index.ts"},
+		},
+		{
+			name:    "longest common directory",
+			files:   []string{"client/web/src/a.ts", "README.md", "client/web/b.ts", "client/web/src/c/d.ts"},
+			entries: []string{"client/web/ (3 files)", "README.md"},
+		},
+		{
+			name:    "top-level directory",
+			files:   []string{"client/web/a.ts", "client/shared/b.ts", "dev/c.sh", "dev/d.sh"},
+			entries: []string{"client/ (2 files)", "dev/ (2 files)"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries := groupByDirectory(test.files)
+			if !reflect.DeepEqual(test.entries, entries) {
+				t.Errorf("expected %q; got %q", test.entries, entries)
+			}
+		})
+	}
+}
+
+func TestWriteNotificationsGroup(t *testing.T) {
+	notifs := map[string][]string{
+		"@web": {"client/web/a.ts", "client/web/b/c.ts", "client/web/d.ts"},
+		"@go":  {"main.go"},
+	}
+	tests := []struct {
+		format string
+		output []string
+	}{
+		{
+			format: "text",
+			output: []string{
+				"a...b",
+				"@go -> main.go",
+				"@web -> client/web/ (3 files)",
+			},
+		},
+		{
+			format: "markdown",
+			output: []string{
+				"<!-- codenotify:CODENOTIFY report -->",
+				"[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff a...b.",
+				"",
+				"| Notify | File(s) |",
+				"|-|-|",
+				"| @go | main.go |",
+				"| @web | client/web/ (3 files) |",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			o := options{filename: "CODENOTIFY", format: test.format, baseRef: "a", headRef: "b", group: true}
+			buf := bytes.Buffer{}
+			if err := o.writeNotifications(&buf, notifs); err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if expected := joinLines(test.output); buf.String() != expected {
+				t.Errorf("\nwant: %q\n got: %q", expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestWriteMarkdownGroupCount(t *testing.T) {
+	var files, groups []string
+	for i := 0; i < 12; i++ {
+		for j := 0; j < 50; j++ {
+			files = append(files, fmt.Sprintf("dir%d/sub/file%d.go", i, j))
+		}
+		groups = append(groups, fmt.Sprintf("dir%d/sub/ (50 files)", i))
+	}
+
+	o := options{filename: "CODENOTIFY", format: "markdown", baseRef: "a", headRef: "b", group: true}
+	buf := bytes.Buffer{}
+	if err := o.writeNotifications(&buf, map[string][]string{"@web": files}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	expected := joinLines([]string{
+		"<!-- codenotify:CODENOTIFY report -->",
+		"[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff a...b.",
+		"",
+		"| Notify | File(s) |",
+		"|-|-|",
+		"| @web | <details><summary>600 files</summary>" + strings.Join(groups, "<br>") + "</details> |",
+	})
+	if buf.String() != expected {
+		t.Errorf("\nwant: %q\n got: %q", expected, buf.String())
+	}
+}
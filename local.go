@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Values for options.local, which is the uncommitted changes that are diffed against the base ref.
+const (
+	// localStaged diffs the changes that are staged for the next commit.
+	localStaged = "staged"
+	// localWorktree diffs all changes in the working tree, including untracked files that aren't ignored.
+	localWorktree = "worktree"
+)
+
+// parseLocal returns the local mode of the -staged and -worktree flags, or "" if neither is set.
+func parseLocal(staged, worktree bool) (string, error) {
+	switch {
+	case staged && worktree:
+		return "", fmt.Errorf("only one of -staged and -worktree can be set")
+	case staged:
+		return localStaged, nil
+	case worktree:
+		return localWorktree, nil
+	}
+	return "", nil
+}
+
+// localDiff returns the paths that differ between the base ref and the staged changes or the working tree,
+// one per line like the output of git diff --name-only.
+func (o *options) localDiff() ([]byte, error) {
+	args := []string{"-C", o.cwd, "diff", "--name-only"}
+	if o.local == localStaged {
+		args = append(args, "--cached")
+	}
+	diff, err := run("git", append(args, o.baseRef)...)
+	if err != nil {
+		return nil, fmt.Errorf("error diffing %s with the %s changes: %w", o.baseRef, o.local, err)
+	}
+	if o.local != localWorktree {
+		return diff, nil
+	}
+
+	// The :/ pathspec lists the untracked files of the whole working tree, even if cwd is a subdirectory.
+	untracked, err := run("git", "-C", o.cwd, "ls-files", "--others", "--exclude-standard", "--full-name", "--", ":/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing untracked files: %w", err)
+	}
+	return append(diff, untracked...), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	os.Unsetenv("GITHUB_ACTIONS")
+	os.Unsetenv("GITLAB_CI")
+	os.Unsetenv("GITEA_ACTIONS")
+	os.Unsetenv("FORGEJO_ACTIONS")
+	os.Unsetenv("BITBUCKET_PR_ID")
+
+	gitroot := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		args = append([]string{"-C", gitroot, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("unable to run git %v: %s\n%s", args, err, string(out))
+		}
+	}
+	write := func(file, content string) {
+		t.Helper()
+		path := filepath.Join(gitroot, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("CODENOTIFY", "**/*.go @go\n**/*.md @docs\n")
+	write("main.go", "package main\n")
+	write("README.md", "# Readme\n")
+	git("init")
+	git("add", ".")
+	git("commit", "-m", "init")
+
+	write("main.go", "package main\n\nfunc main() {}\n")
+	git("add", "main.go")
+	write("README.md", "# Changed\n")
+	write("web/CODENOTIFY", "** @web\n")
+	write("web/index.js", "")
+
+	tests := []struct {
+		name   string
+		args   []string
+		stdout []string
+	}{
+		{
+			name: "staged",
+			args: []string{"-staged"},
+			stdout: []string{
+				"HEAD...staged",
+				"@go -> main.go",
+			},
+		},
+		{
+			name: "worktree",
+			args: []string{"-worktree", "-subscription-changes", "off"},
+			stdout: []string{
+				"HEAD...worktree",
+				"@docs -> README.md",
+				"@go -> main.go",
+			},
+		},
+		{
+			name: "worktree rules",
+			args: []string{"-worktree", "-rules-from", "head", "-subscription-changes", "report"},
+			stdout: []string{
+				"HEAD...worktree",
+				"@docs -> README.md",
+				"@go -> main.go",
+				"@web -> web/CODENOTIFY, web/index.js",
+				"",
+				"Subscription changes in CODENOTIFY files:",
+				"web/CODENOTIFY **: added @web",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			if err := testableMain(stdout, append([]string{"-cwd", filepath.Join(gitroot, "web")}, test.args...)); err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if expected := joinLines(test.stdout); stdout.String() != expected {
+				t.Errorf("want stdout:\n%s\ngot:\n%s", expected, stdout.String())
+			}
+		})
+	}
+}
+
+func TestLocalWithHeadRef(t *testing.T) {
+	for _, local := range []string{"-staged", "-worktree"} {
+		_, err := cliOptions(&bytes.Buffer{}, []string{local, "-headRef", "main"})
+		if expected := "-headRef can't be used with " + local; err == nil || err.Error() != expected {
+			t.Errorf("expected error %q; got %v", expected, err)
+		}
+	}
+}
+
+func TestParseLocal(t *testing.T) {
+	if _, err := parseLocal(true, true); err == nil {
+		t.Error("expected error if both -staged and -worktree are set")
+	}
+	if local, err := parseLocal(false, true); err != nil || local != localWorktree {
+		t.Errorf("expected %q; got %q, %v", localWorktree, local, err)
+	}
+}
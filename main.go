@@ -4,19 +4,20 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
-	"net/http/httputil"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"path"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 )
 
 var verbose io.Writer = os.Stderr
@@ -38,6 +39,11 @@ func isRateLimitErr(err error) bool {
 		return false
 	}
 
+	var rl *rateLimitError
+	if errors.As(err, &rl) {
+		return true
+	}
+
 	return strings.Contains(err.Error(), "API rate limit exceeded")
 }
 
@@ -51,28 +57,86 @@ func testableMain(stdout io.Writer, args []string) error {
 		return nil
 	}
 
-	commits := opts.baseRef + "..." + opts.headRef
-	diff, err := run("git", "-C", opts.cwd, "diff", "--name-only", commits)
+	paths, err := opts.changedPaths()
 	if err != nil {
-		return fmt.Errorf("error diffing %s: %w", commits, err)
+		return err
 	}
 
-	paths, err := readLines(diff)
+	rules := opts.ruleSet()
+	notifs, added, addedFiles, err := rules.notifications(paths)
 	if err != nil {
-		return fmt.Errorf("error scanning lines from diff: %s\n%s", err, string(diff))
+		return err
 	}
+	opts.addedByPullRequest = added
+	opts.filesAddedByPullRequest = addedFiles
 
-	notifs, err := notifications(&gitfs{cwd: opts.cwd, rev: opts.baseRef}, paths, opts.filename)
-	if err != nil {
-		return err
+	if opts.subscriptionChanges == subscriptionChangesReport || opts.subscriptionChanges == subscriptionChangesNotify {
+		opts.changedSubscriptions, err = subscriptionChanges(opts.baseFS(), opts.headFS(), paths, opts.filename)
+		if err != nil {
+			return err
+		}
+		if opts.subscriptionChanges == subscriptionChangesNotify {
+			notifyRemovedSubscribers(notifs, opts.changedSubscriptions)
+		}
 	}
 
 	if opts.author != "" {
 		fmt.Fprintf(verbose, "not notifying pull request author %s\n", opts.author)
-		delete(notifs, opts.author)
+		for sub := range notifs {
+			if handle, _ := splitSubscriber(sub); handle == opts.author {
+				delete(notifs, sub)
+			}
+		}
+	}
+
+	if opts.template != nil {
+		opts.provenance, err = rules.provenance(paths)
+		if err != nil {
+			return err
+		}
 	}
 
-	return opts.print(notifs)
+	if err := opts.print(notifs); err != nil {
+		return err
+	}
+
+	if opts.label == nil {
+		return nil
+	}
+
+	labels, err := rules.labels(paths)
+	if err != nil {
+		return err
+	}
+	return opts.label(labels)
+}
+
+// changedPaths returns the paths that the diff changes, which are the paths or patch that o was given, if any.
+func (o *options) changedPaths() ([]string, error) {
+	if o.paths != nil {
+		return o.paths, nil
+	}
+
+	var diff []byte
+	var err error
+	if o.local != "" {
+		diff, err = o.localDiff()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		commits := o.baseRef + "..." + o.headRef
+		diff, err = run("git", "-C", o.cwd, "diff", "--name-only", commits)
+		if err != nil {
+			return nil, fmt.Errorf("error diffing %s: %w", commits, err)
+		}
+	}
+
+	paths, err := readLines(diff)
+	if err != nil {
+		return nil, fmt.Errorf("error scanning lines from diff: %s\n%s", err, string(diff))
+	}
+	return paths, nil
 }
 
 func run(command string, args ...string) ([]byte, error) {
@@ -86,9 +150,37 @@ func run(command string, args ...string) ([]byte, error) {
 	return out, nil
 }
 
+// deepen fetches enough history of a shallow clone to compute the diff of a
+// pull request with the given number of commits.
+func deepen(cwd string, commitCount int) error {
+	_, err := run("git", "-C", cwd, "-c", "protocol.version=2", "fetch", "--deepen", strconv.Itoa(commitCount))
+	return err
+}
+
+// ciSettings returns the filename and subscriber threshold configured by the
+// CODENOTIFY_FILENAME and CODENOTIFY_SUBSCRIBER_THRESHOLD environment variables,
+// which are used on CI systems other than GitHub Actions.
+func ciSettings() (filename string, subscriberThreshold int) {
+	filename = os.Getenv("CODENOTIFY_FILENAME")
+	if filename == "" {
+		filename = "CODENOTIFY"
+	}
+	subscriberThreshold, _ = strconv.Atoi(os.Getenv("CODENOTIFY_SUBSCRIBER_THRESHOLD"))
+	return filename, subscriberThreshold
+}
+
 func getOptions(stdout io.Writer, args []string) (*options, error) {
-	if os.Getenv("GITHUB_ACTIONS") == "true" {
+	switch {
+	case os.Getenv("GITEA_ACTIONS") == "true" || os.Getenv("FORGEJO_ACTIONS") == "true":
+		// Gitea and Forgejo Actions also set GITHUB_ACTIONS, so they must be detected first.
+		return giteaActionOptions()
+	case os.Getenv("GITHUB_ACTIONS") == "true":
 		return githubActionOptions()
+	// The CLI can also run in GitLab CI and Bitbucket Pipelines, so they are only detected without arguments.
+	case len(args) == 0 && os.Getenv("GITLAB_CI") == "true" && os.Getenv("CI_MERGE_REQUEST_IID") != "":
+		return gitlabOptions()
+	case len(args) == 0 && os.Getenv("BITBUCKET_PR_ID") != "":
+		return bitbucketPipelinesOptions()
 	}
 	return cliOptions(stdout, args)
 }
@@ -99,10 +191,55 @@ func cliOptions(stdout io.Writer, args []string) (*options, error) {
 	flags.StringVar(&opts.cwd, "cwd", "", "The working directory to use.")
 	flags.StringVar(&opts.baseRef, "baseRef", "", "The base ref to use when computing the file diff.")
 	flags.StringVar(&opts.headRef, "headRef", "HEAD", "The head ref to use when computing the file diff.")
+	var staged, worktree bool
+	flags.BoolVar(&staged, "staged", false, "Diff the staged changes against the base ref (HEAD by default) instead of the head ref")
+	flags.BoolVar(&worktree, "worktree", false, "Diff the working tree, including untracked files, against the base ref (HEAD by default) instead of the head ref")
+	var pathsFile, patchFile string
+	flags.StringVar(&pathsFile, "paths", "", "The file with the changed paths, separated by newlines or NUL characters, instead of a git diff (- for stdin)")
+	flags.StringVar(&patchFile, "patch", "", "The unified diff whose changed paths are used instead of a git diff (- for stdin)")
 	flags.StringVar(&opts.author, "author", "", "The author of the diff.")
-	flags.StringVar(&opts.format, "format", "text", "The format of the output: text or markdown")
+	flags.StringVar(&opts.format, "format", "text", "The format of the output: text, markdown, or the webhook payload of teams, mattermost or discord")
+	flags.BoolVar(&opts.group, "group", false, "Group the files of each subscriber by their longest common directory")
+	var templateFile string
+	flags.StringVar(&templateFile, "template", "", "The file with a text/template that replaces the text or markdown output")
+	var mentionMapping string
+	flags.StringVar(&mentionMapping, "mention-mapping", "", "The file that maps handles to identities on the chat platform of the teams, mattermost and discord formats")
 	flags.StringVar(&opts.filename, "filename", "CODENOTIFY", "The filename in which file subscribers are defined")
+	flags.StringVar(&opts.rulesFrom, "rules-from", rulesFromBase, "The revision whose notify files define the rules: base, head, or union (which flags subscribers from the head)")
+	flags.StringVar(&opts.subscriptionChanges, "subscription-changes", subscriptionChangesOff, "What happens when the diff changes notify files: off, report (lists added and removed subscribers) or notify (also notifies removed subscribers)")
 	flags.IntVar(&opts.subscriberThreshold, "subscriber-threshold", 0, "The threshold of notifying subscribers")
+	flags.StringVar(&opts.url, "url", "", "The web URL of the pull request, used to link to it from notifications")
+	var provider, apiURL, repo, pr string
+	flags.StringVar(&provider, "provider", "", "Post or update a comment on a pull request instead of printing notifications: gitlab, gitea, bitbucket-cloud, bitbucket-server or gerrit. The access token (or Gerrit HTTP password) is read from the CODENOTIFY_TOKEN env var.")
+	flags.StringVar(&apiURL, "api-url", "", "The API URL of the provider (e.g. https://gitea.example.com/api/v1), or the URL of the Gerrit server")
+	flags.StringVar(&repo, "repo", "", "The repository of the pull request for the provider (e.g. owner/name)")
+	flags.StringVar(&pr, "pr", "", "The number of the pull request (or Gerrit change) for the provider")
+	var patchset, gerritPost string
+	flags.StringVar(&patchset, "patchset", "current", "The Gerrit patch set to review, which is diffed against its parent")
+	flags.StringVar(&gerritPost, "gerrit-post", gerritPostBoth, "How to notify subscribers of a Gerrit change: message, cc or both")
+	var staleReport string
+	flags.StringVar(&staleReport, "stale-report", staleUpdate, "What happens to the comment of the provider when subscribers no longer match: update, delete (if nobody matches) or strikethrough")
+	slack := slackConfig{
+		apiURL:  "https://slack.com/api",
+		token:   os.Getenv("CODENOTIFY_SLACK_TOKEN"),
+		webhook: os.Getenv("CODENOTIFY_SLACK_WEBHOOK"),
+	}
+	flags.StringVar(&slack.channel, "slack-channel", "", "Also post notifications to this Slack channel. The bot token is read from the CODENOTIFY_SLACK_TOKEN env var, or the incoming webhook URL from CODENOTIFY_SLACK_WEBHOOK.")
+	flags.BoolVar(&slack.dm, "slack-dm", false, "Also send each subscriber a Slack direct message")
+	flags.StringVar(&slack.mapping, "slack-mapping", "", "The file that maps handles to Slack user or user group IDs")
+	flags.StringVar(&slack.state, "slack-state", "", "The file in which posted Slack messages are recorded so that they are updated on the next run")
+	email := emailConfig{
+		username: os.Getenv("CODENOTIFY_SMTP_USERNAME"),
+		password: os.Getenv("CODENOTIFY_SMTP_PASSWORD"),
+	}
+	flags.StringVar(&email.addr, "smtp-addr", "", "Also email subscribers via this SMTP server (host:port). Credentials are read from the CODENOTIFY_SMTP_USERNAME and CODENOTIFY_SMTP_PASSWORD env vars.")
+	flags.StringVar(&email.from, "smtp-from", "", "The sender of emails (e.g. Codenotify <codenotify@example.com>)")
+	flags.StringVar(&email.mapping, "email-mapping", "", "The file that maps handles to email addresses")
+	flags.StringVar(&email.textTemplate, "email-text-template", "", "The file with the text/template of the text body of emails")
+	flags.StringVar(&email.htmlTemplate, "email-html-template", "", "The file with the html/template of the HTML body of emails")
+	flags.StringVar(&email.state, "email-state", "", "The file in which sent emails are recorded so that they are not sent again on the next run")
+	webhook := webhookConfig{secret: os.Getenv("CODENOTIFY_WEBHOOK_SECRET")}
+	flags.StringVar(&webhook.url, "webhook", "", "Also post notifications as JSON to this URL. Payloads are signed with the secret in the CODENOTIFY_WEBHOOK_SECRET env var.")
 	var v bool
 	flags.BoolVar(&v, "verbose", false, "Verbose messages printed to stderr")
 
@@ -116,8 +253,116 @@ func cliOptions(stdout io.Writer, args []string) (*options, error) {
 		verbose = ioutil.Discard
 	}
 
-	opts.print = func(notifs map[string][]string) error {
-		return opts.writeNotifications(stdout, notifs)
+	if err := opts.loadTemplate(templateFile); err != nil {
+		return nil, err
+	}
+
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	opts.local, err = parseLocal(staged, worktree)
+	if err != nil {
+		return nil, err
+	}
+	if opts.local != "" {
+		if provider != "" {
+			return nil, fmt.Errorf("-%s can't be used with -provider", opts.local)
+		}
+		// The staged changes or the working tree are diffed instead of the head ref.
+		if set["headRef"] {
+			return nil, fmt.Errorf("-headRef can't be used with -%s", opts.local)
+		}
+		if opts.baseRef == "" {
+			opts.baseRef = "HEAD"
+		}
+		opts.headRef = opts.local
+	}
+	if (pathsFile != "" || patchFile != "") && !set["headRef"] {
+		// The changes that are read are the head of the diff, unless a head ref is set explicitly.
+		opts.headRef = ""
+	}
+	if err := opts.readChanges(pathsFile, patchFile); err != nil {
+		return nil, err
+	}
+
+	opts.rulesFrom, err = parseRulesFrom("-rules-from", opts.rulesFrom)
+	if err != nil {
+		return nil, err
+	}
+	opts.subscriptionChanges, err = parseSubscriptionChanges("-subscription-changes", opts.subscriptionChanges)
+	if err != nil {
+		return nil, err
+	}
+	if opts.source != "" && (opts.headRef == "" || opts.rulesDir != "") {
+		// There is no head revision to read rules from.
+		if opts.rulesFrom != rulesFromBase {
+			return nil, fmt.Errorf("-rules-from %s needs -baseRef and -headRef with -paths or -patch", opts.rulesFrom)
+		}
+		if opts.subscriptionChanges != subscriptionChangesOff {
+			return nil, fmt.Errorf("-subscription-changes %s needs -baseRef and -headRef with -paths or -patch", opts.subscriptionChanges)
+		}
+	}
+
+	if mentionMapping != "" {
+		opts.chatMapping, err = readMapping(mentionMapping)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch provider {
+	case "gerrit":
+		if apiURL == "" || pr == "" {
+			return nil, fmt.Errorf("the API URL and change must be set for provider gerrit")
+		}
+		if os.Getenv("CODENOTIFY_GERRIT_USERNAME") == "" || os.Getenv("CODENOTIFY_TOKEN") == "" {
+			return nil, fmt.Errorf("env vars CODENOTIFY_GERRIT_USERNAME and CODENOTIFY_TOKEN must be set for provider gerrit")
+		}
+		c := &gerritChange{
+			client:   newGerritClient(apiURL, os.Getenv("CODENOTIFY_GERRIT_USERNAME"), os.Getenv("CODENOTIFY_TOKEN")),
+			change:   pr,
+			patchset: patchset,
+		}
+		o, err := gerritOptions(&opts, c, gerritPost)
+		if o == nil || err != nil {
+			return o, err
+		}
+	case "":
+		opts.print = func(notifs map[string][]string) error {
+			return opts.writeNotifications(stdout, notifs)
+		}
+	default:
+		c, err := newCommenter(provider, apiURL, repo, pr, os.Getenv("CODENOTIFY_TOKEN"))
+		if err != nil {
+			return nil, err
+		}
+		opts.staleReport, err = parseStaleReport("-stale-report", staleReport, false)
+		if err != nil {
+			return nil, err
+		}
+		opts.format = "markdown"
+		opts.print = commentOn(&opts, c)
+	}
+
+	if slack.enabled() {
+		print, err := notifySlack(&opts, slack)
+		if err != nil {
+			return nil, err
+		}
+		opts.addPrint(print)
+	}
+	if email.enabled() {
+		print, err := notifyEmail(&opts, email)
+		if err != nil {
+			return nil, err
+		}
+		opts.addPrint(print)
+	}
+	if webhook.enabled() {
+		opts.addPrint(notifyWebhook(&opts, webhook))
 	}
 	return &opts, nil
 }
@@ -129,14 +374,17 @@ type pullRequest struct {
 	Head struct {
 		Sha string `json:"sha"`
 	} `json:"head"`
-	NodeID string `json:"node_id"`
-	User   struct {
+	NodeID  string `json:"node_id"`
+	Number  int    `json:"number"`
+	HTMLURL string `json:"html_url"`
+	User    struct {
 		Login string `json:"login"`
 	} `json:"User"`
 	Draft bool `json:"draft"`
 }
 
-func githubActionOptions() (*options, error) {
+// readPullRequestEvent reads the pull request from the event that triggered the workflow.
+func readPullRequestEvent() (*pullRequest, error) {
 	path := os.Getenv("GITHUB_EVENT_PATH")
 	if path == "" {
 		return nil, fmt.Errorf("env var GITHUB_EVENT_PATH not set")
@@ -155,22 +403,43 @@ func githubActionOptions() (*options, error) {
 		return nil, fmt.Errorf("unable to decode GitHub event: %s\n%s", err, string(data))
 	}
 
-	if event.PullRequest.Draft {
+	return &event.PullRequest, nil
+}
+
+func githubActionOptions() (*options, error) {
+	pr, err := readPullRequestEvent()
+	if err != nil {
+		return nil, err
+	}
+
+	if pr.Draft {
 		fmt.Fprintln(verbose, "Not sending notifications for draft pull request.")
 		return nil, nil
 	}
 
-	commitCount, err := commitCount(event.PullRequest.NodeID)
+	client, err := newGitHubClientFromEnv()
 	if err != nil {
 		return nil, err
 	}
 
-	cwd := os.Getenv("GITHUB_WORKSPACE")
-	_, err = run("git", "-C", cwd, "-c", "protocol.version=2", "fetch", "--deepen", strconv.Itoa(commitCount))
+	if b := os.Getenv("INPUT_RETRY-BUDGET"); b != "" {
+		seconds, err := strconv.Atoi(b)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid value for input retry-budget: %s", b)
+		}
+		client.retryBudget = time.Duration(seconds) * time.Second
+	}
+
+	commitCount, err := client.commitCount(pr.NodeID)
 	if err != nil {
 		return nil, err
 	}
 
+	cwd := os.Getenv("GITHUB_WORKSPACE")
+	if err := deepen(cwd, commitCount); err != nil {
+		return nil, err
+	}
+
 	filename := os.Getenv("INPUT_FILENAME")
 	if filename == "" {
 		return nil, fmt.Errorf("env var INPUT_FILENAME not set")
@@ -178,236 +447,178 @@ func githubActionOptions() (*options, error) {
 
 	subscriberThreshold, _ := strconv.Atoi(os.Getenv("INPUT_SUBSCRIBER-THRESHOLD"))
 
+	comment := true
+	if c := os.Getenv("INPUT_COMMENT"); c != "" {
+		comment, err = strconv.ParseBool(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for input comment: %s", c)
+		}
+	}
+
+	reviews := os.Getenv("INPUT_REQUEST-REVIEWS")
+	switch reviews {
+	case "":
+		reviews = reviewsAnnotated
+	case reviewsNone, reviewsAnnotated, reviewsAll:
+	default:
+		return nil, fmt.Errorf("invalid value for input request-reviews: %s", reviews)
+	}
+
 	o := &options{
 		cwd:                 cwd,
 		format:              "markdown",
 		filename:            filename,
 		subscriberThreshold: subscriberThreshold,
-		baseRef:             event.PullRequest.Base.Sha,
-		headRef:             event.PullRequest.Head.Sha,
-		author:              "@" + event.PullRequest.User.Login,
+		comment:             comment,
+		requestReviews:      reviews,
+		baseRef:             pr.Base.Sha,
+		headRef:             pr.Head.Sha,
+		author:              "@" + pr.User.Login,
+		url:                 pr.HTMLURL,
+	}
+	if err := o.applyEnv(actionInputs, true); err != nil {
+		return nil, err
+	}
+	o.print = commentOnGitHubPullRequest(o, client, pr.NodeID)
+	o.label = func(labels []string) error {
+		return client.addLabels(pr.NodeID, labels)
 	}
-	o.print = commentOnGitHubPullRequest(o, event.PullRequest.NodeID)
-	return o, nil
-}
-
-func commentOnGitHubPullRequest(o *options, prNodeID string) func(map[string][]string) error {
-	return func(notifs map[string][]string) error {
-		comment := bytes.Buffer{}
-		if err := o.writeNotifications(&comment, notifs); err != nil {
-			return err
-		}
-
-		id, err := existingCommentId(prNodeID, o.filename)
-		if err != nil {
-			return err
-		}
-
-		if id == "" {
-			if len(notifs) == 0 {
-				fmt.Fprintln(verbose, "not adding a comment because there are no notifications to send")
-				return nil
-			}
-			return addComment(prNodeID, comment.String())
-		}
 
-		return updateComment(id, comment.String())
+	if err := addSinksFromEnv(o, actionInputs); err != nil {
+		return nil, err
 	}
+	return o, nil
 }
 
-func updateComment(id, body string) error {
-	fmt.Fprintf(verbose, "updating existing comment: %s\n", id)
-	return graphql(`
-		mutation UpdateComment ($id: ID!, $body: String!) {
-			updateIssueComment(input: {
-				id: $id
-				body: $body
-			}) {
-				clientMutationId
-			}
-		}`,
-		map[string]interface{}{
-			"id":   id,
-			"body": body,
-		},
-		nil,
-	)
-}
-
-func addComment(subjectId, body string) error {
-	fmt.Fprintf(verbose, "adding comment to pr %s\n", subjectId)
-	return graphql(`
-		mutation AddComment ($subjectId: ID!, $body: String!) {
-			addComment(input: {
-				subjectId: $subjectId
-				body: $body
-			}) {
-				clientMutationId
-			}
-		}`,
-		map[string]interface{}{
-			"subjectId": subjectId,
-			"body":      body,
-		},
-		nil,
-	)
-}
-
-func commitCount(prNodeID string) (int, error) {
-	data := struct {
-		Node struct {
-			Commits struct {
-				TotalCount int `json:"totalCount"`
-			} `json:"commits"`
-		} `json:"node"`
-	}{}
-	err := graphql(`
-		query CommitCount ($nodeId: ID!) {
-			node(id: $nodeId) {
-				... on PullRequest {
-					commits {
-						totalCount
-					}
-				}
-			}
-		}`,
-		map[string]interface{}{
-			"nodeId": prNodeID,
-		},
-		&data,
-	)
-
-	return data.Node.Commits.TotalCount, err
-}
-
-func existingCommentId(prNodeID string, filename string) (string, error) {
-	data := struct {
-		Node struct {
-			Comments struct {
-				Nodes []struct {
-					Id     string `json:"id"`
-					Author struct {
-						Login string `json:"login"`
-					} `json:"author"`
-					Body string `json:"body"`
-				} `json:"nodes"`
-			} `json:"comments"`
-		} `json:"node"`
-	}{}
-	err := graphql(`
-		query GetPullRequestComments ($nodeId: ID!) {
-			node(id: $nodeId) {
-				... on PullRequest {
-					comments(first: 100) {
-						nodes {
-							id
-							author {
-								login
-							}
-							body
-						}
-					}
-				}
-			}
-		}`,
-		map[string]interface{}{
-			"nodeId": prNodeID,
-		},
-		&data,
-	)
-	if err != nil {
-		return "", err
-	}
+type options struct {
+	cwd                 string
+	baseRef             string
+	headRef             string
+	format              string
+	filename            string
+	subscriberThreshold int
+	author              string
+	comment             bool
+	requestReviews      string
+	// url is the web URL of the pull request, if known.
+	url   string
+	print func(notifs map[string][]string) error
+	// label, if set, is called with the labels of all rules that match the diff.
+	label func(labels []string) error
+	// mention, if set, returns the markup that mentions a subscriber handle in markdown.
+	mention func(handle string) string
+	// chatMapping maps handles to identities on the chat platform of the teams, mattermost and discord formats.
+	chatMapping map[string]string
+	// template, if set, replaces the built-in text and markdown output.
+	template *template.Template
+	// provenance is the rules that subscribe each handle to each file, which is only computed for templates.
+	provenance map[string]map[string][]rule
+	// group, if set, groups the files of each subscriber by directory in text and markdown output.
+	group bool
+	// staleReport is what happens to the report comment when subscribers no longer match (e.g. staleDelete).
+	staleReport string
+	// unsubscribed are the handles that the report comment notified before but that no longer match,
+	// which markdown output strikes through.
+	unsubscribed []string
+	// rulesFrom is the revision whose notify files define the rules (e.g. rulesFromBase).
+	rulesFrom string
+	// addedByPullRequest is the set of handles that are only subscribers because of the notify files
+	// of the head revision, which text and markdown output flag.
+	addedByPullRequest map[string]bool
+	// filesAddedByPullRequest are the files, by handle, that other subscribers are only notified about
+	// because of the notify files of the head revision, which text and markdown output flag.
+	filesAddedByPullRequest map[string]map[string]bool
+	// subscriptionChanges is what happens when the diff changes notify files (e.g. subscriptionChangesReport).
+	subscriptionChanges string
+	// changedSubscriptions are the subscription changes of the diff, which text and markdown output list.
+	changedSubscriptions []subscriptionChange
+	// source, if set, is the file (or stdin) that the changed paths were read from with -paths or -patch.
+	source string
+	// local is the uncommitted changes that are diffed instead of the head ref (e.g. localStaged), if any.
+	local string
+	// paths are the changed paths of the -paths or -patch input, or nil to diff the refs with git.
+	paths []string
+	// fileChanges are the changes of the -patch input by path, including the old paths of renamed files.
+	fileChanges map[string]fileChange
+	// rulesDir is the directory that rules are read from instead of git revisions, if set.
+	rulesDir string
+}
 
-	for _, comment := range data.Node.Comments.Nodes {
-		if strings.HasPrefix(comment.Body, markdownCommentTitle(filename)) {
-			return comment.Id, nil
+// addPrint adds a print function that is called after the existing one (e.g. to send notifications to another destination).
+func (o *options) addPrint(print func(notifs map[string][]string) error) {
+	previous := o.print
+	o.print = func(notifs map[string][]string) error {
+		if err := previous(notifs); err != nil {
+			return err
 		}
+		return print(notifs)
 	}
-
-	return "", nil
 }
 
-func graphql(query string, variables map[string]interface{}, responseData interface{}) error {
-	reqbody, err := json.Marshal(map[string]interface{}{
-		"query":     query,
-		"variables": variables,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to marshal query %s and variables %s: %w", query, variables, err)
-	}
-
-	req, err := http.NewRequest(http.MethodPost, os.Getenv("GITHUB_GRAPHQL_URL"), bytes.NewBuffer(reqbody))
-	if err != nil {
+// addSinksFromEnv adds the destinations of notifications that are configured by the env vars of n.
+func addSinksFromEnv(o *options, n envNaming) error {
+	if err := addSlackFromEnv(o, n); err != nil {
 		return err
 	}
-
-	token := os.Getenv("GITHUB_TOKEN")
-	if token == "" {
-		return fmt.Errorf("GITHUB_TOKEN is not set")
-	}
-	req.Header.Set("Authorization", "bearer "+token)
-
-	reqdump, err := httputil.DumpRequestOut(req, true)
-	if err != nil {
-		return fmt.Errorf("error dumping request: %w", err)
-	}
-
-	cl := &http.Client{}
-	resp, err := cl.Do(req)
-	if err != nil {
+	if err := addEmailFromEnv(o, n); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	respdump, err := httputil.DumpResponse(resp, true)
-	if err != nil {
-		return fmt.Errorf("error dumping response: %w", err)
-	}
-
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("non-200 response:\n%s\n\nrequest:\n%s", string(respdump), string(reqdump))
-	}
-
-	response := struct {
-		Data   interface{}
-		Errors []struct {
-			Type    string   `json:"type"`
-			Path    []string `json:"path"`
-			Message string   `json:"message"`
-		} `json:"errors"`
-	}{
-		Data: responseData,
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return fmt.Errorf("error decoding json response:\n%s\n%w", respdump, err)
-	}
-
-	if len(response.Errors) > 0 {
-		return fmt.Errorf("graphql error: %s\nrequest:\n%s", response.Errors[0].Message, reqdump)
-	}
-
+	addWebhookFromEnv(o, n)
 	return nil
 }
 
-type options struct {
-	cwd                 string
-	baseRef             string
-	headRef             string
-	format              string
-	filename            string
-	subscriberThreshold int
-	author              string
-	print               func(notifs map[string][]string) error
+// Values for options.requestReviews.
+const (
+	// reviewsNone never requests reviews.
+	reviewsNone = "none"
+	// reviewsAnnotated requests reviews from subscribers with the :review mode.
+	reviewsAnnotated = "annotated"
+	// reviewsAll requests reviews from all subscribers that are not silent.
+	reviewsAll = "all"
+)
+
+// reviewers returns the sorted handles of the subscribers whose review should be requested.
+func (o *options) reviewers(notifs map[string][]string) []string {
+	reviewers := []string{}
+	for sub := range notifs {
+		handle, mode := splitSubscriber(sub)
+		switch {
+		case o.requestReviews == reviewsNone:
+		case mode == modeReview:
+			reviewers = append(reviewers, handle)
+		case o.requestReviews == reviewsAll && mode != modeSilent:
+			reviewers = append(reviewers, handle)
+		}
+	}
+	sort.Strings(reviewers)
+	return reviewers
 }
 
 func markdownCommentTitle(filename string) string {
 	return fmt.Sprintf("<!-- codenotify:%s report -->\n", filename)
 }
 
+// exceedsThreshold returns true if notifs has more subscribers than the
+// configured subscriber threshold.
+func (o *options) exceedsThreshold(notifs map[string][]string) bool {
+	return o.subscriberThreshold > 0 && len(notifs) > o.subscriberThreshold
+}
+
 func (o *options) writeNotifications(w io.Writer, notifs map[string][]string) error {
-	if o.subscriberThreshold > 0 && len(notifs) > o.subscriberThreshold {
+	if write, ok := chatFormats[o.format]; ok {
+		// Chat formats are JSON payloads, so they handle the threshold themselves.
+		return write(o, w, notifs)
+	}
+
+	if o.template != nil {
+		if o.format == "markdown" {
+			// The title identifies the report comment to update.
+			fmt.Fprint(w, markdownCommentTitle(o.filename))
+		}
+		return o.writeTemplate(w, notifs)
+	}
+
+	if o.exceedsThreshold(notifs) {
 		fmt.Fprintf(w, "Not notifying subscribers because the number of notifying subscribers (%d) has exceeded the threshold (%d).\n", len(notifs), o.subscriberThreshold)
 		return nil
 	}
@@ -417,38 +628,92 @@ func (o *options) writeNotifications(w io.Writer, notifs map[string][]string) er
 		subs = append(subs, sub)
 	}
 	sort.Strings(subs)
+	notifs = o.markFilesFromPullRequest(notifs)
 
 	switch o.format {
 	case "text":
-		fmt.Fprintf(w, "%s...%s\n", o.baseRef, o.headRef)
-		if len(notifs) == 0 {
-			fmt.Fprintln(w, "No notifications.")
-		} else {
-			for _, sub := range subs {
-				files := notifs[sub]
-				fmt.Fprintln(w, sub, "->", strings.Join(files, ", "))
-			}
+		if o.group {
+			// Markdown groups the files itself, so that it can still count them.
+			notifs = groupNotifications(notifs)
 		}
-		return nil
-	case "markdown":
-		fmt.Fprint(w, markdownCommentTitle(o.filename))
-		fmt.Fprintf(w, "[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in %s files for diff %s...%s.\n\n", o.filename, o.baseRef, o.headRef)
+		fmt.Fprintf(w, "%s\n", o.diff())
 		if len(notifs) == 0 {
 			fmt.Fprintln(w, "No notifications.")
 		} else {
-			fmt.Fprint(w, "| Notify | File(s) |\n")
-			fmt.Fprint(w, "|-|-|\n")
 			for _, sub := range subs {
 				files := notifs[sub]
-				fmt.Fprintf(w, "| %s | %s |\n", sub, strings.Join(files, "<br>"))
+				fmt.Fprintln(w, textSubscriber(sub)+o.fromPullRequest(sub), "->", strings.Join(files, ", "))
 			}
 		}
+		fmt.Fprint(w, o.textSubscriptionChanges())
 		return nil
+	case "markdown":
+		return o.writeMarkdown(w, subs, notifs)
 	default:
 		return fmt.Errorf("unsupported format: %s", o.format)
 	}
 }
 
+// fromPullRequest returns the note that flags a subscriber who is only notified because of
+// the notify files of the pull request itself, or an empty string.
+func (o *options) fromPullRequest(sub string) string {
+	if handle, _ := splitSubscriber(sub); o.addedByPullRequest[handle] {
+		return " (from this pull request)"
+	}
+	return ""
+}
+
+// markFilesFromPullRequest returns notifs with the note of fromPullRequest after each file
+// that a subscriber is only notified about because of the notify files of the pull request.
+func (o *options) markFilesFromPullRequest(notifs map[string][]string) map[string][]string {
+	if len(o.filesAddedByPullRequest) == 0 {
+		return notifs
+	}
+	marked := make(map[string][]string, len(notifs))
+	for sub, files := range notifs {
+		handle, _ := splitSubscriber(sub)
+		added := o.filesAddedByPullRequest[handle]
+		if len(added) == 0 {
+			marked[sub] = files
+			continue
+		}
+		for _, file := range files {
+			if added[file] {
+				file += " (from this pull request)"
+			}
+			marked[sub] = append(marked[sub], file)
+		}
+	}
+	return marked
+}
+
+// textSubscriber formats a subscriber for text output.
+func textSubscriber(sub string) string {
+	handle, mode := splitSubscriber(sub)
+	if mode == modeMention {
+		return handle
+	}
+	return fmt.Sprintf("%s (%s)", handle, mode)
+}
+
+// markdownSubscriber formats a subscriber for markdown output.
+// Silent subscribers are wrapped in a code span so that they are not mentioned.
+func (o *options) markdownSubscriber(sub string) string {
+	handle, mode := splitSubscriber(sub)
+	if mode == modeSilent {
+		return "`" + handle + "`"
+	}
+
+	mention := handle
+	if o.mention != nil {
+		mention = o.mention(handle)
+	}
+	if mode == modeReview {
+		return mention + " (review)"
+	}
+	return mention
+}
+
 func readLines(b []byte) ([]string, error) {
 	lines := []string{}
 	scanner := bufio.NewScanner(bytes.NewBuffer(b))
@@ -458,32 +723,177 @@ func readLines(b []byte) ([]string, error) {
 	return lines, scanner.Err()
 }
 
+// notifyMode is the kind of notification that a subscriber receives.
+type notifyMode string
+
+const (
+	// modeMention mentions the subscriber (e.g. @alice).
+	modeMention notifyMode = ""
+	// modeSilent lists the subscriber without mentioning them (e.g. @alice:silent).
+	modeSilent notifyMode = "silent"
+	// modeReview mentions the subscriber and requests their review (e.g. @alice:review).
+	modeReview notifyMode = "review"
+)
+
+// rank orders modes so that the strongest one wins when a subscriber
+// is matched by multiple rules with different modes.
+func (m notifyMode) rank() int {
+	switch m {
+	case modeSilent:
+		return 0
+	case modeMention:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// splitSubscriber splits a subscriber like @alice:silent into its handle and mode.
+func splitSubscriber(sub string) (string, notifyMode) {
+	if i := strings.LastIndex(sub, ":"); i >= 0 {
+		return sub[:i], notifyMode(sub[i+1:])
+	}
+	return sub, modeMention
+}
+
+// parseSubscriber is like splitSubscriber but returns an error for unknown modes.
+func parseSubscriber(sub string) (string, notifyMode, error) {
+	handle, mode := splitSubscriber(sub)
+	switch mode {
+	case modeMention, modeSilent, modeReview:
+	default:
+		return "", "", fmt.Errorf("unknown notification mode %q for subscriber %s", mode, handle)
+	}
+	if handle == "" {
+		return "", "", fmt.Errorf("missing handle for subscriber %s", sub)
+	}
+	return handle, mode, nil
+}
+
+// notifications returns the files that each subscriber should be notified about.
+// Subscribers are keyed by handle, suffixed with the notification mode unless it is a mention.
+// A subscriber matched with several modes gets the strongest of them.
 func notifications(fs FS, paths []string, notifyFilename string) (map[string][]string, error) {
-	notifications := map[string][]string{}
+	files := map[string][]string{}
+	modes := map[string]notifyMode{}
 	for _, path := range paths {
 		subs, err := subscribers(fs, path, notifyFilename)
 		if err != nil {
 			return nil, err
 		}
 
+		seen := map[string]bool{}
 		for _, sub := range subs {
-			notifications[sub] = append(notifications[sub], path)
+			handle, mode := splitSubscriber(sub)
+			if m, ok := modes[handle]; !ok || mode.rank() > m.rank() {
+				modes[handle] = mode
+			}
+
+			if !seen[handle] {
+				seen[handle] = true
+				files[handle] = append(files[handle], path)
+			}
+		}
+	}
+
+	notifications := map[string][]string{}
+	for handle, f := range files {
+		sub := handle
+		if mode := modes[handle]; mode != modeMention {
+			sub += ":" + string(mode)
 		}
+		notifications[sub] = f
 	}
 
 	return notifications, nil
 }
 
-func subscribers(fs FS, path string, notifyFilename string) ([]string, error) {
+func subscribers(fs FS, file string, notifyFilename string) ([]string, error) {
 	fmt.Fprintf(verbose, "analyzing subscribers in %s files\n", notifyFilename)
+	rules, err := matchingRules(fs, file, notifyFilename)
+	if err != nil {
+		return nil, err
+	}
+
 	subscribers := []string{}
+	for _, r := range rules {
+		subscribers = append(subscribers, r.subscribers...)
+	}
+	return subscribers, nil
+}
+
+// labels returns the sorted, deduplicated labels of all rules that match any of the paths.
+func labels(fs FS, paths []string, notifyFilename string) ([]string, error) {
+	fmt.Fprintf(verbose, "analyzing labels in %s files\n", notifyFilename)
+	seen := map[string]bool{}
+	labels := []string{}
+	for _, path := range paths {
+		rules, err := matchingRules(fs, path, notifyFilename)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range rules {
+			for _, label := range r.labels {
+				if !seen[label] {
+					seen[label] = true
+					labels = append(labels, label)
+				}
+			}
+		}
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
+
+// labelPrefix marks a field of a rule as a label instead of a subscriber (e.g. label=database).
+const labelPrefix = "label="
+
+// rule is a single rule in a notify file.
+type rule struct {
+	// file is the path of the notify file and line is the line number of the rule in it.
+	file        string
+	line        int
+	pattern     string
+	re          *regexp.Regexp
+	subscribers []string
+	labels      []string
+}
 
-	parts := strings.Split(path, string(os.PathSeparator))
+// parseRule parses the fields of a rule from the notify file at rulefilepath.
+func parseRule(rulefilepath, line string, fields []string) (rule, error) {
+	r := rule{file: rulefilepath, pattern: fields[0]}
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, labelPrefix) {
+			label := strings.TrimPrefix(field, labelPrefix)
+			if label == "" {
+				return rule{}, fmt.Errorf("empty label in %s: %s", rulefilepath, line)
+			}
+			r.labels = append(r.labels, label)
+			continue
+		}
+
+		if _, _, err := parseSubscriber(field); err != nil {
+			return rule{}, fmt.Errorf("invalid subscriber in %s: %s: %w", rulefilepath, line, err)
+		}
+		r.subscribers = append(r.subscribers, field)
+	}
+	return r, nil
+}
+
+// matchingRules returns the rules in all notify files that match file.
+func matchingRules(fs FS, file string, notifyFilename string) ([]rule, error) {
+	rules := []rule{}
+
+	// Paths in a git repository are always separated by forward slashes,
+	// regardless of the operating system, so use the path package here and
+	// not path/filepath.
+	parts := strings.Split(file, "/")
 	for i := range parts {
-		base := filepath.Join(parts[:i]...)
-		rulefilepath := filepath.Join(base, notifyFilename)
+		base := path.Join(parts[:i]...)
+		rulefilepath := path.Join(base, notifyFilename)
 
-		rulefile, err := fs.Open(rulefilepath)
+		fileRules, err := readRules(fs, rulefilepath)
 		if err != nil {
 			if err == os.ErrNotExist {
 				continue
@@ -491,44 +901,72 @@ func subscribers(fs FS, path string, notifyFilename string) ([]string, error) {
 			return nil, err
 		}
 
-		scanner := bufio.NewScanner(rulefile)
-		for scanner.Scan() {
-			rule := scanner.Text()
-			if rule != "" && rule[0] == '#' {
-				// skip comment
-				continue
+		rel := relativePath(base, file)
+		for _, r := range fileRules {
+			if r.re.MatchString(rel) {
+				rules = append(rules, r)
 			}
+		}
+	}
 
-			fields := strings.Fields(rule)
-			switch len(fields) {
-			case 0:
-				// skip blank line
-				continue
-			case 1:
-				return nil, fmt.Errorf("expected at least two fields for rule in %s: %s", rulefilepath, rule)
-			}
+	return rules, nil
+}
 
-			rel, err := filepath.Rel(base, path)
-			if err != nil {
-				return nil, err
-			}
+// readRules returns the rules in the notify file at rulefilepath, or os.ErrNotExist if it doesn't exist.
+func readRules(fs FS, rulefilepath string) ([]rule, error) {
+	rulefile, err := fs.Open(rulefilepath)
+	if err != nil {
+		return nil, err
+	}
+	defer rulefile.Close()
 
-			re, err := patternToRegexp(fields[0])
-			if err != nil {
-				return nil, fmt.Errorf("invalid pattern in %s: %s: %w", rulefilepath, rule, err)
-			}
+	rules := []rule{}
+	scanner := bufio.NewScanner(rulefile)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		rule := scanner.Text()
+		if rule != "" && rule[0] == '#' {
+			// skip comment
+			continue
+		}
 
-			if re.MatchString(rel) {
-				subscribers = append(subscribers, fields[1:]...)
-			}
+		fields := strings.Fields(rule)
+		switch len(fields) {
+		case 0:
+			// skip blank line
+			continue
+		case 1:
+			return nil, fmt.Errorf("expected at least two fields for rule in %s: %s", rulefilepath, rule)
 		}
 
-		if err := scanner.Err(); err != nil {
+		re, err := patternToRegexp(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern in %s: %s: %w", rulefilepath, rule, err)
+		}
+
+		r, err := parseRule(rulefilepath, rule, fields)
+		if err != nil {
 			return nil, err
 		}
+		r.line = lineNumber
+		r.re = re
+		rules = append(rules, r)
 	}
 
-	return subscribers, nil
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// relativePath returns the slash-separated path of file relative to the
+// directory base, which must be an ancestor of file (or empty for the root).
+func relativePath(base, file string) string {
+	if base == "" {
+		return file
+	}
+	return strings.TrimPrefix(file, base+"/")
 }
 
 func patternToRegexp(pattern string) (*regexp.Regexp, error) {
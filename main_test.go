@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -12,10 +15,15 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMain(t *testing.T) {
 	os.Unsetenv("GITHUB_ACTIONS")
+	os.Unsetenv("GITLAB_CI")
+	os.Unsetenv("GITEA_ACTIONS")
+	os.Unsetenv("FORGEJO_ACTIONS")
+	os.Unsetenv("BITBUCKET_PR_ID")
 	tests := []struct {
 		name         string
 		opts         options
@@ -239,6 +247,50 @@ func TestWriteNotifications(t *testing.T) {
 				"@js -> file.js, dir/file.js",
 			},
 		},
+		{
+			name: "markdown modes",
+			opts: options{
+				filename: "CODENOTIFY",
+				format:   "markdown",
+				baseRef:  "a",
+				headRef:  "b",
+			},
+			notifs: map[string][]string{
+				"@go":        {"file.go"},
+				"@js:silent": {"file.js"},
+				"@md:review": {"file.md"},
+			},
+			output: []string{
+				"<!-- codenotify:CODENOTIFY report -->",
+				"[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff a...b.",
+				"",
+				"| Notify | File(s) |",
+				"|-|-|",
+				"| @go | file.go |",
+				"| `@js` | file.js |",
+				"| @md (review) | file.md |",
+			},
+		},
+		{
+			name: "text modes",
+			opts: options{
+				filename: "CODENOTIFY",
+				format:   "text",
+				baseRef:  "a",
+				headRef:  "b",
+			},
+			notifs: map[string][]string{
+				"@go":        {"file.go"},
+				"@js:silent": {"file.js"},
+				"@md:review": {"file.md"},
+			},
+			output: []string{
+				"a...b",
+				"@go -> file.go",
+				"@js (silent) -> file.js",
+				"@md (review) -> file.md",
+			},
+		},
 		{
 			name: "unsupported format",
 			opts: options{
@@ -283,6 +335,59 @@ func TestWriteNotifications(t *testing.T) {
 	}
 }
 
+func TestReviewers(t *testing.T) {
+	notifs := map[string][]string{
+		"@go":            {"file.go"},
+		"@js:silent":     {"file.js"},
+		"@md:review":     {"file.md"},
+		"@org/team":      {"file.go"},
+		"@org/db:review": {"file.sql"},
+	}
+
+	tests := []struct {
+		requestReviews string
+		reviewers      []string
+	}{
+		{
+			requestReviews: reviewsNone,
+			reviewers:      []string{},
+		},
+		{
+			requestReviews: reviewsAnnotated,
+			reviewers:      []string{"@md", "@org/db"},
+		},
+		{
+			requestReviews: reviewsAll,
+			reviewers:      []string{"@go", "@md", "@org/db", "@org/team"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.requestReviews, func(t *testing.T) {
+			o := options{requestReviews: test.requestReviews}
+			if reviewers := o.reviewers(notifs); !reflect.DeepEqual(test.reviewers, reviewers) {
+				t.Errorf("expected reviewers %v; got %v", test.reviewers, reviewers)
+			}
+		})
+	}
+}
+
+// markdownReport returns a function that formats a markdown report whose body consists of lines.
+func markdownReport(filename, baseRef, headRef string) func(lines ...string) string {
+	return func(lines ...string) string {
+		return joinLines(append([]string{
+			markdownCommentTitle(filename) + fmt.Sprintf("[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in %s files for diff %s...%s.", filename, baseRef, headRef),
+			"",
+		}, lines...))
+	}
+}
+
+// notifiedList returns the hidden list of notified handles at the end of a report.
+func notifiedList(handles ...string) string {
+	list, _ := json.Marshal(append([]string{}, handles...))
+	return notifiedMarker + string(list) + " -->"
+}
+
 func joinLines(lines []string) string {
 	joined := strings.Join(lines, "\n")
 	if joined == "" {
@@ -614,6 +719,51 @@ func TestNotifications(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:     "notification modes",
+			filename: "CODENOTIFY",
+			fs: memfs{
+				"CODENOTIFY":  "*.md @alice:silent @bob:review @carol\n",
+				"file.md":     "",
+				"dir/file.md": "",
+			},
+			notifications: map[string][]string{
+				"@alice:silent": {"file.md"},
+				"@bob:review":   {"file.md"},
+				"@carol":        {"file.md"},
+			},
+		},
+		{
+			name:     "strongest notification mode wins",
+			filename: "CODENOTIFY",
+			fs: memfs{
+				"CODENOTIFY": "\n" +
+					"*.md @alice:silent @bob:silent @carol:silent\n" +
+					"dir/** @alice @bob:review @carol:silent\n" +
+					"**/*.md @bob\n",
+				"file.md":     "",
+				"dir/file.md": "",
+			},
+			notifications: map[string][]string{
+				"@alice":        {"file.md", "dir/file.md"},
+				"@bob:review":   {"file.md", "dir/file.md"},
+				"@carol:silent": {"file.md", "dir/file.md"},
+			},
+		},
+		{
+			name:     "labels are not subscribers",
+			filename: "CODENOTIFY",
+			fs: memfs{
+				"CODENOTIFY": "\n" +
+					"db/** @dba label=database\n" +
+					"*.md label=docs\n",
+				"file.md":       "",
+				"db/schema.sql": "",
+			},
+			notifications: map[string][]string{
+				"@dba": {"db/schema.sql"},
+			},
+		},
 		{
 			name:     "no notifications for OWNERS",
 			filename: "OWNERS",
@@ -676,6 +826,207 @@ func TestNotifications(t *testing.T) {
 	}
 }
 
+func TestLabels(t *testing.T) {
+	fs := memfs{
+		"CODENOTIFY": "\n" +
+			"db/** @dba label=database\n" +
+			"**/*.md label=docs label=needs-review\n" +
+			"*.go @go\n",
+		"db/CODENOTIFY": "*.sql label=database label=migrations\n",
+		"file.md":       "",
+		"file.go":       "",
+		"db/schema.sql": "",
+		"db/readme.md":  "",
+	}
+
+	tests := []struct {
+		name   string
+		paths  []string
+		labels []string
+	}{
+		{
+			name:   "no labels",
+			paths:  []string{"file.go"},
+			labels: []string{},
+		},
+		{
+			name:   "multiple labels",
+			paths:  []string{"file.md"},
+			labels: []string{"docs", "needs-review"},
+		},
+		{
+			name:   "deduplicated across rules and files",
+			paths:  []string{"db/schema.sql", "db/readme.md"},
+			labels: []string{"database", "docs", "migrations", "needs-review"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			labels, err := labels(fs, test.paths, "CODENOTIFY")
+			if err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if !reflect.DeepEqual(test.labels, labels) {
+				t.Errorf("expected labels %v; got %v", test.labels, labels)
+			}
+		})
+	}
+
+	_, err := labels(memfs{"CODENOTIFY": "* label=\n"}, []string{"file.md"}, "CODENOTIFY")
+	expected := "empty label in CODENOTIFY: * label="
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q; got %v", expected, err)
+	}
+}
+
+func TestNotificationsInvalidMode(t *testing.T) {
+	fs := memfs{
+		"CODENOTIFY": "*.md @alice:loud\n",
+		"file.md":    "",
+	}
+	_, err := notifications(fs, []string{"file.md"}, "CODENOTIFY")
+	expected := `invalid subscriber in CODENOTIFY: *.md @alice:loud: unknown notification mode "loud" for subscriber @alice`
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q; got %v", expected, err)
+	}
+}
+
+// TestNotificationsPathSeparator verifies that repository paths are always
+// treated as slash separated, as git reports them, no matter which path
+// separator the host operating system uses.
+func TestNotificationsPathSeparator(t *testing.T) {
+	fs := memfs{
+		"CODENOTIFY":     "** @root\n",
+		"dir/CODENOTIFY": "** @dir\n",
+	}
+
+	tests := []struct {
+		name          string
+		paths         []string
+		notifications map[string][]string
+	}{
+		{
+			name:  "forward slashes",
+			paths: []string{"dir/file.md"},
+			notifications: map[string][]string{
+				"@root": {"dir/file.md"},
+				"@dir":  {"dir/file.md"},
+			},
+		},
+		{
+			// A backslash is a valid filename character in git and must not be
+			// interpreted as a directory separator (as it would be on Windows).
+			name:  "backslashes",
+			paths: []string{`dir\file.md`},
+			notifications: map[string][]string{
+				"@root": {`dir\file.md`},
+			},
+		},
+		{
+			name:  "mixed",
+			paths: []string{`dir/sub\file.md`},
+			notifications: map[string][]string{
+				"@root": {`dir/sub\file.md`},
+				"@dir":  {`dir/sub\file.md`},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opened := []string{}
+			recorder := recordingfs{fs: fs, opened: &opened}
+			notifs, err := notifications(recorder, test.paths, "CODENOTIFY")
+			if err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if !reflect.DeepEqual(test.notifications, notifs) {
+				t.Errorf("expected notifications %v; got %v", test.notifications, notifs)
+			}
+			for _, name := range opened {
+				if strings.Contains(name, `\`) || strings.HasPrefix(name, "/") {
+					t.Errorf("opened non-canonical rule file path %q", name)
+				}
+			}
+		})
+	}
+}
+
+func TestRelativePath(t *testing.T) {
+	tests := []struct {
+		base string
+		file string
+		rel  string
+	}{
+		{base: "", file: "file.md", rel: "file.md"},
+		{base: "", file: "dir/file.md", rel: "dir/file.md"},
+		{base: "dir", file: "dir/file.md", rel: "file.md"},
+		{base: "dir", file: "dir/sub/file.md", rel: "sub/file.md"},
+		{base: "dir/sub", file: `dir/sub/a\b.md`, rel: `a\b.md`},
+	}
+
+	for _, test := range tests {
+		if rel := relativePath(test.base, test.file); rel != test.rel {
+			t.Errorf("relativePath(%q, %q) = %q; want %q", test.base, test.file, rel, test.rel)
+		}
+	}
+}
+
+// setenv sets an environment variable for the duration of the test.
+func setenv(t *testing.T, key, value string) {
+	original, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, original)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestAddSinksFromCIVariables(t *testing.T) {
+	posted := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted++
+	}))
+	defer server.Close()
+	setenv(t, "CODENOTIFY_WEBHOOK", server.URL)
+
+	printed := 0
+	o := &options{filename: "CODENOTIFY", print: func(map[string][]string) error {
+		printed++
+		return nil
+	}}
+	if err := addSinksFromEnv(o, ciVariables); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if err := o.print(map[string][]string{"@go": {"file.go"}}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if printed != 1 || posted != 1 {
+		t.Errorf("expected the comment and the webhook; got %d comments and %d webhook posts", printed, posted)
+	}
+}
+
+func TestGetOptionsWithArgsInCI(t *testing.T) {
+	setenv(t, "GITHUB_ACTIONS", "")
+	setenv(t, "GITEA_ACTIONS", "")
+	setenv(t, "FORGEJO_ACTIONS", "")
+	setenv(t, "GITLAB_CI", "true")
+	setenv(t, "CI_MERGE_REQUEST_IID", "1")
+	setenv(t, "BITBUCKET_PR_ID", "1")
+
+	o, err := getOptions(&bytes.Buffer{}, []string{"-baseRef", "a", "-headRef", "b"})
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if o.baseRef != "a" || o.headRef != "b" {
+		t.Errorf("expected the refs of the arguments; got %s...%s", o.baseRef, o.headRef)
+	}
+}
+
 func TestIsRateLimitErr(t *testing.T) {
 	cases := []struct {
 		err      error
@@ -693,6 +1044,12 @@ func TestIsRateLimitErr(t *testing.T) {
 		}, {
 			err:      fmt.Errorf("something something: API rate limit exceeded for user ID 12345"),
 			expected: true,
+		}, {
+			err:      fmt.Errorf("wrapped: %w", &rateLimitError{secondary: true}),
+			expected: true,
+		}, {
+			err:      redactError(&rateLimitError{retryAfter: time.Minute}, "token"),
+			expected: true,
 		},
 	}
 
@@ -726,3 +1083,14 @@ func (m memfs) Open(name string) (File, error) {
 
 	return mf, nil
 }
+
+// recordingfs wraps an FS and records the name of every file opened.
+type recordingfs struct {
+	fs     FS
+	opened *[]string
+}
+
+func (r recordingfs) Open(name string) (File, error) {
+	*r.opened = append(*r.opened, name)
+	return r.fs.Open(name)
+}
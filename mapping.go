@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readMapping reads a file that maps subscriber handles to identities on another system
+// (e.g. Slack user IDs or email addresses). Each line is a handle followed by whitespace
+// and the value, which is the rest of the line. Empty lines and lines that start with a # are ignored.
+//
+//	@alice    U024BE7LH
+//	@org/qa   QA Team <qa@example.com>
+func readMapping(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mapping file: %w", err)
+	}
+	defer f.Close()
+
+	mapping := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("expected a handle and a value in mapping file %s: %s", filename, line)
+		}
+		handle := fields[0]
+		mapping[handle] = strings.TrimSpace(strings.TrimPrefix(line, handle))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
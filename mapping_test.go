@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		mapping map[string]string
+		err     string
+	}{
+		{
+			name:    "values",
+			content: "# comment\n\n@alice   U024BE7LH\n  @org/qa QA Team <qa@example.com>  \n",
+			mapping: map[string]string{
+				"@alice":  "U024BE7LH",
+				"@org/qa": "QA Team <qa@example.com>",
+			},
+		},
+		{
+			name:    "missing value",
+			content: "@alice\n",
+			err:     "expected a handle and a value in mapping file %s: @alice",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "mapping")
+			writeFile(t, filename, test.content)
+
+			mapping, err := readMapping(filename)
+			if test.err != "" {
+				if expected := fmt.Sprintf(test.err, filename); err == nil || err.Error() != expected {
+					t.Fatalf("expected error %q; got %v", expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if !reflect.DeepEqual(test.mapping, mapping) {
+				t.Errorf("expected %v; got %v", test.mapping, mapping)
+			}
+		})
+	}
+}
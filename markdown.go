@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// markdownMaxLength is the maximum length of a markdown comment, which is GitHub's limit on the body of a comment.
+const markdownMaxLength = 65536
+
+// markdownCollapseFiles is the number of files of a subscriber above which they are collapsed in a <details> block.
+const markdownCollapseFiles = 10
+
+// markdownFileLimits are the decreasing numbers of entries that the files of each subscriber are rolled up to,
+// until the comment fits in markdownMaxLength.
+var markdownFileLimits = []int{100, 30, 10, 3}
+
+// writeMarkdown writes the markdown comment for the notifications of the sorted subscribers,
+// followed by the unsubscribed handles and the subscription changes. Long lists of files are rolled up into directories,
+// and subscribers that don't fit in the comment are omitted.
+func (o *options) writeMarkdown(w io.Writer, subs []string, notifs map[string][]string) error {
+	header := markdownCommentTitle(o.filename)
+	header += fmt.Sprintf("[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in %s files for diff %s.\n\n", o.filename, o.diff())
+	footer := o.markdownSubscriptionChanges()
+	if len(footer) > markdownMaxLength/2 {
+		footer = fmt.Sprintf("\n%d subscription changes in %s files.\n", len(o.changedSubscriptions), o.filename)
+	}
+	if len(notifs) == 0 && len(o.unsubscribed) == 0 {
+		_, err := fmt.Fprint(w, header, "No notifications.\n", footer)
+		return err
+	}
+	header += "| Notify | File(s) |\n|-|-|\n"
+
+	var rows []string
+	for _, limit := range markdownFileLimits {
+		rows = rows[:0]
+		length := len(header) + len(footer)
+		for _, sub := range subs {
+			row := fmt.Sprintf("| %s%s | %s |\n", o.markdownSubscriber(sub), o.fromPullRequest(sub), o.markdownFiles(notifs[sub], limit))
+			rows = append(rows, row)
+			length += len(row)
+		}
+		for _, handle := range o.unsubscribed {
+			row := fmt.Sprintf("| ~~`%s`~~ | no longer subscribed |\n", handle)
+			rows = append(rows, row)
+			length += len(row)
+		}
+		if length <= markdownMaxLength {
+			_, err := fmt.Fprint(w, header, strings.Join(rows, ""), footer)
+			return err
+		}
+	}
+
+	// Even the smallest rollups don't fit, so there are too many subscribers.
+	length := len(header) + len(markdownOmitted(len(rows))) + len(footer)
+	n := 0
+	for n < len(rows) && length+len(rows[n]) <= markdownMaxLength {
+		length += len(rows[n])
+		n++
+	}
+	_, err := fmt.Fprint(w, header, strings.Join(rows[:n], ""), markdownOmitted(len(rows)-n), footer)
+	return err
+}
+
+// markdownOmitted returns the line that follows the table if n subscribers are omitted from it.
+func markdownOmitted(n int) string {
+	return fmt.Sprintf("\nand %d more subscribers.\n", n)
+}
+
+// markdownFiles formats the files of a subscriber for a table cell, with at most limit entries.
+// If o groups files, they are grouped by directory unless that takes more than limit entries.
+func (o *options) markdownFiles(files []string, limit int) string {
+	entries := rollupFiles(files, limit)
+	if o.group {
+		if groups := groupByDirectory(files); len(groups) <= limit {
+			entries = groups
+		}
+	}
+	cell := strings.Join(entries, "<br>")
+	if len(files) <= markdownCollapseFiles {
+		return cell
+	}
+	return fmt.Sprintf("<details><summary>%d files</summary>%s</details>", len(files), cell)
+}
+
+// rollupFiles returns at most limit entries for files. If there are more files than that, files are rolled up
+// into their directories at the deepest level that fits (e.g. "client/web/ (143 files)"). If even the top-level
+// directories don't fit, the last entry summarizes the rest (e.g. "and 12 more files").
+func rollupFiles(files []string, limit int) []string {
+	if len(files) <= limit {
+		return files
+	}
+
+	maxDepth := 0
+	for _, file := range files {
+		if depth := strings.Count(file, "/"); depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+
+	groups := groupFiles(files, maxDepth+1)
+	for depth := maxDepth; depth > 0 && len(groups) > limit; depth-- {
+		groups = groupFiles(files, depth)
+	}
+
+	entries := make([]string, 0, limit)
+	shown := 0
+	for i, g := range groups {
+		if len(groups) > limit && i == limit-1 {
+			entries = append(entries, fmt.Sprintf("and %d more files", len(files)-shown))
+			break
+		}
+		entries = append(entries, g.String())
+		shown += len(g.files)
+	}
+	return entries
+}
+
+// fileGroup is a directory and the files in it, or a single file.
+type fileGroup struct {
+	dir   string
+	files []string
+}
+
+func (g fileGroup) String() string {
+	if len(g.files) == 1 {
+		return g.files[0]
+	}
+	return fmt.Sprintf("%s (%d files)", g.dir, len(g.files))
+}
+
+// groupFiles groups the files by their directory at depth (e.g. client/web/ at depth 2), in the order of files.
+// Files with fewer directories than depth are groups of their own.
+func groupFiles(files []string, depth int) []fileGroup {
+	var groups []fileGroup
+	index := map[string]int{}
+	for _, file := range files {
+		key := file
+		if parts := strings.Split(file, "/"); len(parts) > depth {
+			key = strings.Join(parts[:depth], "/") + "/"
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, fileGroup{dir: key})
+		}
+		groups[i].files = append(groups[i].files, file)
+	}
+	return groups
+}
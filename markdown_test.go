@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRollupFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		limit   int
+		entries []string
+	}{
+		{
+			name:    "fits",
+			files:   []string{"a.go", "dir/b.go"},
+			limit:   2,
+			entries: []string{"a.go", "dir/b.go"},
+		},
+		{
+			name:    "deepest directory",
+			files:   []string{"a.go", "client/web/a.ts", "client/web/b.ts", "client/web/c.ts", "client/shared/d.ts"},
+			limit:   3,
+			entries: []string{"a.go", "client/web/ (3 files)", "client/shared/d.ts"},
+		},
+		{
+			name:    "top-level directory",
+			files:   []string{"a.go", "client/web/a.ts", "client/web/b.ts", "client/shared/d.ts", "client/shared/e.ts"},
+			limit:   2,
+			entries: []string{"a.go", "client/ (4 files)"},
+		},
+		{
+			name:    "more files",
+			files:   []string{"a.go", "b.go", "c.go", "dir/d.go", "dir/e.go"},
+			limit:   3,
+			entries: []string{"a.go", "b.go", "and 3 more files"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries := rollupFiles(test.files, test.limit)
+			if !reflect.DeepEqual(test.entries, entries) {
+				t.Errorf("expected %q; got %q", test.entries, entries)
+			}
+		})
+	}
+}
+
+func TestMarkdownFilesGroup(t *testing.T) {
+	o := options{group: true}
+	tests := []struct {
+		name  string
+		files []string
+		limit int
+		cell  string
+	}{
+		{
+			name:  "groups",
+			files: []string{"a/x/1.go", "a/x/2.go", "b/1.go"},
+			limit: 3,
+			cell:  "a/x/ (2 files)<br>b/1.go",
+		},
+		{
+			name:  "too many groups",
+			files: []string{"a/x/1.go", "a/x/2.go", "b/1.go", "c/1.go", "d/1.go", "e/1.go"},
+			limit: 3,
+			cell:  "a/ (2 files)<br>b/1.go<br>and 3 more files",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if cell := o.markdownFiles(test.files, test.limit); cell != test.cell {
+				t.Errorf("expected %q; got %q", test.cell, cell)
+			}
+		})
+	}
+}
+
+func TestWriteMarkdownDetails(t *testing.T) {
+	var files []string
+	for i := 0; i < 11; i++ {
+		files = append(files, fmt.Sprintf("file%d.go", i))
+	}
+	o := options{filename: "CODENOTIFY", format: "markdown", baseRef: "a", headRef: "b"}
+
+	buf := bytes.Buffer{}
+	if err := o.writeNotifications(&buf, map[string][]string{"@go": files, "@js": {"a.js"}}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	expected := joinLines([]string{
+		"<!-- codenotify:CODENOTIFY report -->",
+		"[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff a...b.",
+		"",
+		"| Notify | File(s) |",
+		"|-|-|",
+		"| @go | <details><summary>11 files</summary>" + strings.Join(files, "<br>") + "</details> |",
+		"| @js | a.js |",
+	})
+	if buf.String() != expected {
+		t.Errorf("\nwant: %q\n got: %q", expected, buf.String())
+	}
+}
+
+func TestWriteMarkdownLimit(t *testing.T) {
+	// syntheticFiles returns n files in a deep tree with long paths.
+	syntheticFiles := func(n int) []string {
+		files := make([]string, n)
+		for i := range files {
+			files[i] = fmt.Sprintf("client/web/src/components/group%d/feature%d/Component%dWithALongName.tsx", i%7, i%97, i)
+		}
+		return files
+	}
+
+	tests := []struct {
+		name     string
+		notifs   map[string][]string
+		contains []string
+	}{
+		{
+			name:     "one subscriber",
+			notifs:   map[string][]string{"@web": syntheticFiles(10000)},
+			contains: []string{"| @web | <details><summary>10000 files</summary>client/web/src/components/group0/ (1429 files)<br>"},
+		},
+		{
+			name: "many subscribers",
+			notifs: func() map[string][]string {
+				notifs := map[string][]string{}
+				files := syntheticFiles(10000)
+				for i := 0; i < 100; i++ {
+					notifs[fmt.Sprintf("@team%02d", i)] = files[i*100 : (i+1)*100]
+				}
+				return notifs
+			}(),
+			contains: []string{"| @team00 | <details><summary>100 files</summary>", "| @team99 |"},
+		},
+		{
+			name: "too many subscribers",
+			notifs: func() map[string][]string {
+				notifs := map[string][]string{}
+				for i, file := range syntheticFiles(10000) {
+					notifs[fmt.Sprintf("@user%04d", i)] = []string{file}
+				}
+				return notifs
+			}(),
+			contains: []string{"| @user0000 | client/web/src/components/group0/feature0/Component0WithALongName.tsx |", "more subscribers.\n"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := options{filename: "CODENOTIFY", format: "markdown", baseRef: "a", headRef: "b"}
+			buf := bytes.Buffer{}
+			if err := o.writeNotifications(&buf, test.notifs); err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+
+			if buf.Len() > markdownMaxLength {
+				t.Errorf("expected comment to fit in %d characters; got %d", markdownMaxLength, buf.Len())
+			}
+			for _, s := range test.contains {
+				if !strings.Contains(buf.String(), s) {
+					t.Errorf("expected comment to contain %q", s)
+				}
+			}
+		})
+	}
+}
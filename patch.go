@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// stdin is what the -paths and -patch inputs read if they are -.
+var stdin io.Reader = os.Stdin
+
+// Change types of fileChange.
+const (
+	changeAdded    = "added"
+	changeModified = "modified"
+	changeDeleted  = "deleted"
+	changeRenamed  = "renamed"
+	changeCopied   = "copied"
+)
+
+// fileChange is a file that a patch changes.
+type fileChange struct {
+	// path is the path of the file after the change, or before it if the file is deleted.
+	path string
+	// from is the path of the file that a renamed or copied file was renamed or copied from.
+	from   string
+	change string
+}
+
+// readChanges sets the changed paths of o to the ones in the file pathsFile, or in the patch in patchFile,
+// unless both are empty, and labels the diff with the file (or stdin) as its source. Unless a base ref is set,
+// rules are then read from the working directory.
+func (o *options) readChanges(pathsFile, patchFile string) error {
+	switch {
+	case pathsFile == "" && patchFile == "":
+		return nil
+	case pathsFile != "" && patchFile != "":
+		return fmt.Errorf("only one of -paths and -patch can be set")
+	case o.local != "":
+		return fmt.Errorf("-paths and -patch can't be used with -%s", o.local)
+	}
+
+	if pathsFile != "" {
+		data, err := readInput(pathsFile)
+		if err != nil {
+			return fmt.Errorf("unable to read paths: %w", err)
+		}
+		o.paths = parsePaths(data)
+	} else {
+		data, err := readInput(patchFile)
+		if err != nil {
+			return fmt.Errorf("unable to read patch: %w", err)
+		}
+		changes, err := parsePatch(data)
+		if err != nil {
+			return err
+		}
+		o.paths = patchPaths(changes)
+		o.fileChanges = map[string]fileChange{}
+		for _, c := range changes {
+			o.fileChanges[c.path] = c
+			if c.change == changeRenamed {
+				o.fileChanges[c.from] = c
+			}
+		}
+	}
+
+	if o.baseRef == "" {
+		// There may be no history to read rules from (e.g. in a sandbox), so they are read from the working directory.
+		o.rulesDir = o.cwd
+		if o.rulesDir == "" {
+			o.rulesDir = "."
+		}
+	}
+	o.source = pathsFile + patchFile
+	if o.source == "-" {
+		o.source = "stdin"
+	}
+	return nil
+}
+
+// diff describes the diff in output (e.g. a1b2c3...d4e5f6). Without a head ref, the changes that were read
+// with -paths or -patch are described by their source, and rules that are read from the working directory
+// by "worktree" (e.g. worktree...stdin).
+func (o *options) diff() string {
+	base, head := o.baseRef, o.headRef
+	if base == "" && o.rulesDir != "" {
+		base = "worktree"
+	}
+	if head == "" {
+		head = o.source
+	}
+	return base + "..." + head
+}
+
+// readInput returns the contents of the file name, or of stdin if name is -.
+func readInput(name string) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// parsePaths returns the paths in data, which are separated by NUL characters if there are any
+// (e.g. the output of git diff --name-only -z), or else by newlines. Empty paths are ignored.
+func parsePaths(data []byte) []string {
+	sep := "\n"
+	if bytes.IndexByte(data, 0) >= 0 {
+		sep = "\x00"
+	}
+
+	paths := []string{}
+	for _, p := range strings.Split(string(data), sep) {
+		if sep == "\n" {
+			p = strings.TrimSuffix(p, "\r")
+		}
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// patchPaths returns the paths that changes change, in order and without duplicates.
+// Both the old and the new path of a renamed file are changed.
+func patchPaths(changes []fileChange) []string {
+	seen := map[string]bool{}
+	paths := []string{}
+	for _, c := range changes {
+		for _, p := range []string{c.path, c.from} {
+			if p == "" || seen[p] || (p == c.from && c.change != changeRenamed) {
+				continue
+			}
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// patchFile is a file in a patch while it is parsed.
+type patchFile struct {
+	oldPath, newPath string
+	change           string
+	// minus is true once the --- line of the file has been read.
+	minus bool
+}
+
+func (f patchFile) fileChange() fileChange {
+	switch f.change {
+	case changeDeleted:
+		return fileChange{path: f.oldPath, change: f.change}
+	case changeRenamed, changeCopied:
+		return fileChange{path: f.newPath, from: f.oldPath, change: f.change}
+	}
+	return fileChange{path: f.newPath, change: f.change}
+}
+
+// parsePatch returns the files that a unified diff changes, in the order of the diff. It understands both
+// plain unified diffs, in which each file starts with its --- and +++ lines, and the extended headers of
+// git diffs, which also describe renames, copies, and changes without hunks (e.g. of binary files).
+// The a/ and b/ prefixes of paths are removed.
+func parsePatch(data []byte) ([]fileChange, error) {
+	var files []patchFile
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\r")
+		var f *patchFile
+		if len(files) > 0 {
+			f = &files[len(files)-1]
+		}
+
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			path := gitDiffHeaderPath(line[len("diff --git "):])
+			files = append(files, patchFile{oldPath: path, newPath: path, change: changeModified})
+		case strings.HasPrefix(line, "--- "):
+			if f == nil || f.minus {
+				files = append(files, patchFile{change: changeModified})
+				f = &files[len(files)-1]
+			}
+			f.minus = true
+			if path := patchPath(line[len("--- "):]); path != "" {
+				f.oldPath = path
+			} else {
+				f.change = changeAdded
+			}
+		case strings.HasPrefix(line, "+++ ") && f != nil && f.minus:
+			if path := patchPath(line[len("+++ "):]); path != "" {
+				f.newPath = path
+			} else {
+				f.change = changeDeleted
+			}
+		case strings.HasPrefix(line, "@@ ") && f != nil:
+			n, err := hunkLength(lines[i+1:], line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid patch on line %d: %w", i+1, err)
+			}
+			i += n
+		case f == nil:
+			// Text before the first file, like the message of a commit.
+		case strings.HasPrefix(line, "new file mode "):
+			f.change = changeAdded
+		case strings.HasPrefix(line, "deleted file mode "):
+			f.change = changeDeleted
+		case strings.HasPrefix(line, "rename from "), strings.HasPrefix(line, "copy from "):
+			f.oldPath = unquotePath(line[strings.Index(line, " from ")+len(" from "):])
+		case strings.HasPrefix(line, "rename to "), strings.HasPrefix(line, "copy to "):
+			f.newPath = unquotePath(line[strings.Index(line, " to ")+len(" to "):])
+			f.change = changeRenamed
+			if strings.HasPrefix(line, "copy ") {
+				f.change = changeCopied
+			}
+		}
+	}
+
+	if len(files) == 0 && len(bytes.TrimSpace(data)) > 0 {
+		return nil, fmt.Errorf("invalid patch: no changed files")
+	}
+	changes := make([]fileChange, 0, len(files))
+	for _, f := range files {
+		changes = append(changes, f.fileChange())
+	}
+	return changes, nil
+}
+
+// hunkLength returns the number of lines that follow the hunk header in lines.
+func hunkLength(lines []string, header string) (int, error) {
+	// The line counts are 1 if they are omitted (e.g. @@ -1 +1 @@).
+	oldCount, newCount := 1, 1
+	fields := strings.Fields(header)
+	if len(fields) < 4 || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return 0, fmt.Errorf("invalid hunk header %q", header)
+	}
+	for _, c := range []struct {
+		field string
+		count *int
+	}{{fields[1], &oldCount}, {fields[2], &newCount}} {
+		if i := strings.Index(c.field, ","); i >= 0 {
+			n, err := strconv.Atoi(c.field[i+1:])
+			if err != nil {
+				return 0, fmt.Errorf("invalid hunk header %q", header)
+			}
+			*c.count = n
+		}
+	}
+
+	n := 0
+	for oldCount > 0 || newCount > 0 {
+		if n >= len(lines) {
+			return 0, fmt.Errorf("hunk %q ends early", header)
+		}
+		line := strings.TrimSuffix(lines[n], "\r")
+		n++
+		switch {
+		case line == "" || line[0] == ' ':
+			// Some tools remove the trailing space of empty context lines.
+			oldCount--
+			newCount--
+		case line[0] == '-':
+			oldCount--
+		case line[0] == '+':
+			newCount--
+		case line[0] == '\\':
+			// \ No newline at end of file
+		default:
+			return 0, fmt.Errorf("hunk %q ends early", header)
+		}
+	}
+	return n, nil
+}
+
+// patchPath returns the path of a --- or +++ line without its a/ or b/ prefix and timestamp,
+// or an empty string for /dev/null.
+func patchPath(s string) string {
+	if !strings.HasPrefix(s, `"`) {
+		if i := strings.Index(s, "\t"); i >= 0 {
+			s = s[:i]
+		}
+	}
+	s = unquotePath(strings.TrimRight(s, " "))
+	if s == "/dev/null" {
+		return ""
+	}
+	if strings.HasPrefix(s, "a/") || strings.HasPrefix(s, "b/") {
+		return s[2:]
+	}
+	return s
+}
+
+// gitDiffHeaderPath returns the path of the "a/path b/path" names of a diff --git line, which is only
+// ambiguous if the path contains " b/". The paths of renamed files are read from later header lines.
+func gitDiffHeaderPath(names string) string {
+	if strings.HasPrefix(names, `"`) {
+		// Both names are quoted if either needs to be, and the path is the same in both.
+		if i := strings.Index(names, `" "`); i >= 0 {
+			return patchPath(names[:i+1])
+		}
+		return patchPath(names)
+	}
+	if n := len(names) / 2; len(names)%2 == 1 && names[n] == ' ' && strings.TrimPrefix(names[:n], "a/") == strings.TrimPrefix(names[n+1:], "b/") {
+		return patchPath(names[:n])
+	}
+	if i := strings.LastIndex(names, " b/"); i >= 0 {
+		return patchPath(names[i+1:])
+	}
+	return patchPath(names)
+}
+
+// unquotePath returns the path that git quoted because it contains special characters (e.g. "caf\303\251.go"),
+// or s if it isn't quoted.
+func unquotePath(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	if path, err := strconv.Unquote(s); err == nil {
+		return path
+	}
+	return s
+}
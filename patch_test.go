@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePaths(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		paths []string
+	}{
+		{
+			name:  "newlines",
+			data:  "a.go\r\ndir/b.go\n\nc.go",
+			paths: []string{"a.go", "dir/b.go", "c.go"},
+		},
+		{
+			name:  "nul",
+			data:  "a.go\x00dir/with\nnewline.go\x00",
+			paths: []string{"a.go", "dir/with\nnewline.go"},
+		},
+		{
+			name:  "empty",
+			data:  "",
+			paths: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			paths := parsePaths([]byte(test.data))
+			if !reflect.DeepEqual(test.paths, paths) {
+				t.Errorf("expected %q; got %q", test.paths, paths)
+			}
+		})
+	}
+}
+
+func TestParsePatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   []string
+		changes []fileChange
+		err     string
+	}{
+		{
+			name: "git",
+			patch: []string{
+				"From 1234 Mon Sep 17 00:00:00 2001",
+				"Subject: [PATCH] Change files",
+				"",
+				"diff --git a/main.go b/main.go",
+				"index 1111111..2222222 100644",
+				"--- a/main.go",
+				"+++ b/main.go",
+				"@@ -1,3 +1,3 @@",
+				" package main",
+				"--- not a header",
+				"+++ not a header",
+				" ",
+				"diff --git a/new.go b/new.go",
+				"new file mode 100644",
+				"--- /dev/null",
+				"+++ b/new.go",
+				"@@ -0,0 +1 @@",
+				"+package main",
+				"\\ No newline at end of file",
+				"diff --git a/old.go b/old.go",
+				"deleted file mode 100644",
+				"--- a/old.go",
+				"+++ /dev/null",
+				"@@ -1 +0,0 @@",
+				"-package main",
+				"diff --git a/web/a.ts b/client/a.ts",
+				"similarity index 100%",
+				"rename from web/a.ts",
+				"rename to client/a.ts",
+				"diff --git a/web/b.ts b/web/c.ts",
+				"similarity index 90%",
+				"copy from web/b.ts",
+				"copy to web/c.ts",
+				"--- a/web/b.ts",
+				"+++ b/web/c.ts",
+				"@@ -1 +1 @@",
+				"-a",
+				"+b",
+				"diff --git a/logo.png b/logo.png",
+				"new file mode 100644",
+				"Binary files /dev/null and b/logo.png differ",
+				"diff --git \"a/caf\\303\\251.go\" \"b/caf\\303\\251.go\"",
+				"old mode 100644",
+				"new mode 100755",
+			},
+			changes: []fileChange{
+				{path: "main.go", change: changeModified},
+				{path: "new.go", change: changeAdded},
+				{path: "old.go", change: changeDeleted},
+				{path: "client/a.ts", from: "web/a.ts", change: changeRenamed},
+				{path: "web/c.ts", from: "web/b.ts", change: changeCopied},
+				{path: "logo.png", change: changeAdded},
+				{path: "café.go", change: changeModified},
+			},
+		},
+		{
+			name: "unified",
+			patch: []string{
+				"--- a/file.go\t2024-01-01 00:00:00.000000000 +0000",
+				"+++ b/file.go\t2024-01-02 00:00:00.000000000 +0000",
+				"@@ -1,2 +1,2 @@",
+				"-old",
+				"+new",
+				"",
+				"--- /dev/null",
+				"+++ dir/added.go",
+				"@@ -0,0 +1 @@",
+				"+new",
+			},
+			changes: []fileChange{
+				{path: "file.go", change: changeModified},
+				{path: "dir/added.go", change: changeAdded},
+			},
+		},
+		{
+			name: "short hunk",
+			patch: []string{
+				"--- a/file.go",
+				"+++ b/file.go",
+				"@@ -1,2 +1,2 @@",
+				"-old",
+			},
+			err: `invalid patch on line 3: hunk "@@ -1,2 +1,2 @@" ends early`,
+		},
+		{
+			name:  "not a patch",
+			patch: []string{"file.go"},
+			err:   "invalid patch: no changed files",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes, err := parsePatch([]byte(joinLines(test.patch)))
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("expected error %q; got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if !reflect.DeepEqual(test.changes, changes) {
+				t.Errorf("expected changes\n%+v\ngot\n%+v", test.changes, changes)
+			}
+		})
+	}
+}
+
+func TestPatchPaths(t *testing.T) {
+	paths := patchPaths([]fileChange{
+		{path: "client/a.ts", from: "web/a.ts", change: changeRenamed},
+		{path: "web/c.ts", from: "web/b.ts", change: changeCopied},
+		{path: "old.go", change: changeDeleted},
+	})
+	expected := []string{"client/a.ts", "web/a.ts", "web/c.ts", "old.go"}
+	if !reflect.DeepEqual(expected, paths) {
+		t.Errorf("expected %q; got %q", expected, paths)
+	}
+}
+
+func TestReadChanges(t *testing.T) {
+	os.Unsetenv("GITHUB_ACTIONS")
+	os.Unsetenv("GITLAB_CI")
+	os.Unsetenv("GITEA_ACTIONS")
+	os.Unsetenv("FORGEJO_ACTIONS")
+	os.Unsetenv("BITBUCKET_PR_ID")
+	originalStdin := stdin
+	defer func() { stdin = originalStdin }()
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "CODENOTIFY"), []byte("**/*.ts @web\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	patch := joinLines([]string{
+		"diff --git a/web/a.ts b/client/a.ts",
+		"similarity index 100%",
+		"rename from web/a.ts",
+		"rename to client/a.ts",
+	})
+
+	t.Run("paths", func(t *testing.T) {
+		stdin = strings.NewReader("web/a.ts\x00README.md\x00")
+		stdout := &bytes.Buffer{}
+		if err := testableMain(stdout, []string{"-cwd", dir, "-paths", "-"}); err != nil {
+			t.Fatalf("expected nil error; got %s", err)
+		}
+		if expected := joinLines([]string{"worktree...stdin", "@web -> web/a.ts"}); stdout.String() != expected {
+			t.Errorf("want stdout:\n%s\ngot:\n%s", expected, stdout.String())
+		}
+	})
+
+	t.Run("patch template", func(t *testing.T) {
+		patchFile := filepath.Join(dir, "change.diff")
+		if err := ioutil.WriteFile(patchFile, []byte(patch), 0666); err != nil {
+			t.Fatal(err)
+		}
+		templateFile := filepath.Join(dir, "template")
+		if err := ioutil.WriteFile(templateFile, []byte("{{range .Subscribers}}{{range .Files}}{{.Path}} {{.Change}} {{.From}}{{.To}}\n{{end}}{{end}}"), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		stdout := &bytes.Buffer{}
+		if err := testableMain(stdout, []string{"-cwd", dir, "-patch", patchFile, "-template", templateFile}); err != nil {
+			t.Fatalf("expected nil error; got %s", err)
+		}
+		if expected := joinLines([]string{"client/a.ts renamed web/a.ts", "web/a.ts renamed client/a.ts"}); stdout.String() != expected {
+			t.Errorf("want stdout:\n%s\ngot:\n%s", expected, stdout.String())
+		}
+	})
+
+	t.Run("base ref", func(t *testing.T) {
+		stdin = strings.NewReader("web/a.ts\n")
+		opts, err := cliOptions(&bytes.Buffer{}, []string{"-cwd", dir, "-paths", "-", "-baseRef", "HEAD"})
+		if err != nil {
+			t.Fatalf("expected nil error; got %s", err)
+		}
+		if opts.headRef != "" || opts.source != "stdin" {
+			t.Errorf("expected no head ref and source stdin; got %q and %q", opts.headRef, opts.source)
+		}
+		if diff := opts.diff(); diff != "HEAD...stdin" {
+			t.Errorf("expected diff HEAD...stdin; got %s", diff)
+		}
+	})
+
+	t.Run("head rules", func(t *testing.T) {
+		for _, args := range [][]string{
+			{"-rules-from", "head"},
+			{"-rules-from", "union", "-baseRef", "HEAD"},
+			{"-subscription-changes", "report"},
+			{"-subscription-changes", "notify", "-baseRef", "HEAD"},
+		} {
+			stdin = strings.NewReader(patch)
+			_, err := cliOptions(&bytes.Buffer{}, append([]string{"-cwd", dir, "-patch", "-"}, args...))
+			expected := fmt.Sprintf("%s %s needs -baseRef and -headRef with -paths or -patch", args[0], args[1])
+			if err == nil || err.Error() != expected {
+				t.Errorf("expected error %q for %q; got %v", expected, args, err)
+			}
+		}
+	})
+
+	t.Run("both", func(t *testing.T) {
+		if err := testableMain(&bytes.Buffer{}, []string{"-paths", "-", "-patch", "-"}); err == nil {
+			t.Error("expected error if both -paths and -patch are set")
+		}
+	})
+}
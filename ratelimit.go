@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// now and sleep are variables so that tests can fake the passage of time.
+var (
+	now   = time.Now
+	sleep = time.Sleep
+)
+
+// secondaryRateLimitWait is how long to wait after hitting a secondary rate limit
+// when GitHub doesn't say how long to wait.
+const secondaryRateLimitWait = time.Minute
+
+// rateLimitError is returned when a GitHub API request has been rate limited.
+type rateLimitError struct {
+	// secondary is true if a secondary rate limit was exceeded.
+	secondary bool
+	// retryAfter is how long to wait before retrying, or zero if unknown.
+	retryAfter time.Duration
+	// details describes the response that was rate limited.
+	details string
+}
+
+func (e *rateLimitError) Error() string {
+	msg := "API rate limit exceeded"
+	if e.secondary {
+		msg = "secondary " + msg
+	}
+	if e.retryAfter > 0 {
+		msg += fmt.Sprintf(" (retry after %s)", e.retryAfter)
+	}
+	if e.details != "" {
+		msg += ":\n" + e.details
+	}
+	return msg
+}
+
+// statusError is returned when the GitHub API responds with an unexpected status code.
+type statusError struct {
+	statusCode int
+	details    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("non-200 response:\n%s", e.details)
+}
+
+// rateLimit returns a *rateLimitError if resp, with the given body, indicates
+// that the request was rate limited, and nil otherwise.
+func rateLimit(resp *http.Response, body []byte) *rateLimitError {
+	retryAfter := retryAfter(resp.Header)
+	remaining := resp.Header.Get("X-RateLimit-Remaining")
+	secondary := strings.Contains(strings.ToLower(string(body)), "secondary rate limit")
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+	case resp.StatusCode == http.StatusForbidden && (remaining == "0" || secondary || retryAfter > 0):
+	default:
+		return nil
+	}
+
+	if secondary && retryAfter == 0 {
+		retryAfter = secondaryRateLimitWait
+	}
+
+	return &rateLimitError{
+		secondary:  secondary,
+		retryAfter: retryAfter,
+	}
+}
+
+// retryAfter returns how long GitHub asks clients to wait before retrying a request,
+// based on the Retry-After and X-RateLimit-Reset response headers, or zero if unknown.
+func retryAfter(h http.Header) time.Duration {
+	if s, err := strconv.Atoi(h.Get("Retry-After")); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+
+	if h.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			if d := time.Unix(reset, 0).Sub(now()); d > 0 {
+				return d
+			}
+		}
+	}
+
+	return 0
+}
+
+// retryDelay returns how long to wait before retrying a request that failed with err,
+// and whether the request should be retried at all.
+func retryDelay(err error, attempt int) (time.Duration, bool) {
+	var rl *rateLimitError
+	if errors.As(err, &rl) {
+		if rl.retryAfter > 0 {
+			// Jitter so that concurrent clients don't all retry at the same moment.
+			return rl.retryAfter + time.Duration(rand.Int63n(int64(time.Second))), true
+		}
+		return backoff(attempt), true
+	}
+
+	var se *statusError
+	if errors.As(err, &se) {
+		return backoff(attempt), se.statusCode >= 500 || se.statusCode == http.StatusTooManyRequests
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return backoff(attempt), true
+	}
+
+	return 0, false
+}
+
+// backoff returns an exponentially increasing, jittered delay for the given retry attempt.
+func backoff(attempt int) time.Duration {
+	d := time.Second << uint(attempt)
+	if max := 30 * time.Second; d > max || d <= 0 {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// isQuery returns true if the GraphQL document is a query, which is safe to retry, and not a mutation.
+func isQuery(document string) bool {
+	document = strings.TrimSpace(document)
+	return strings.HasPrefix(document, "query") || strings.HasPrefix(document, "{")
+}
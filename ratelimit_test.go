@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// response is a canned HTTP response served by a fake GitHub API.
+type response struct {
+	status int
+	header map[string]string
+	body   string
+}
+
+func TestGraphqlRetries(t *testing.T) {
+	fakeNow := time.Unix(1600000000, 0)
+	reset := strconv.FormatInt(fakeNow.Add(30*time.Second).Unix(), 10)
+	success := response{status: 200, body: `{"data": {"viewer": {"login": "codenotify"}}}`}
+
+	tests := []struct {
+		name      string
+		query     string
+		budget    time.Duration
+		responses []response
+		requests  int
+		minWaited time.Duration
+		rateLimit bool
+	}{
+		{
+			name:      "success",
+			query:     "query { viewer { login } }",
+			budget:    time.Minute,
+			responses: []response{success},
+			requests:  1,
+		},
+		{
+			name:   "primary rate limit waits until reset",
+			query:  "query { viewer { login } }",
+			budget: time.Minute,
+			responses: []response{
+				{status: 403, header: map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": reset}, body: `{"message": "API rate limit exceeded"}`},
+				success,
+			},
+			requests:  2,
+			minWaited: 30 * time.Second,
+		},
+		{
+			name:   "429 with Retry-After",
+			query:  "query { viewer { login } }",
+			budget: time.Minute,
+			responses: []response{
+				{status: 429, header: map[string]string{"Retry-After": "3"}},
+				{status: 429, header: map[string]string{"Retry-After": "5"}},
+				success,
+			},
+			requests:  3,
+			minWaited: 8 * time.Second,
+		},
+		{
+			name:   "secondary rate limit without Retry-After",
+			query:  "query { viewer { login } }",
+			budget: 2 * time.Minute,
+			responses: []response{
+				{status: 403, body: `{"message": "You have exceeded a secondary rate limit."}`},
+				success,
+			},
+			requests:  2,
+			minWaited: secondaryRateLimitWait,
+		},
+		{
+			name:   "graphql RATE_LIMITED error",
+			query:  "query { viewer { login } }",
+			budget: time.Minute,
+			responses: []response{
+				{status: 200, header: map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": reset}, body: `{"errors": [{"type": "RATE_LIMITED", "message": "API rate limit exceeded"}]}`},
+				success,
+			},
+			requests:  2,
+			minWaited: 30 * time.Second,
+		},
+		{
+			name:   "server error backs off",
+			query:  "query { viewer { login } }",
+			budget: time.Minute,
+			responses: []response{
+				{status: 502, body: "bad gateway"},
+				success,
+			},
+			requests: 2,
+		},
+		{
+			name:   "rate limit exceeds budget",
+			query:  "query { viewer { login } }",
+			budget: time.Minute,
+			responses: []response{
+				{status: 429, header: map[string]string{"Retry-After": "120"}},
+				success,
+			},
+			requests:  1,
+			rateLimit: true,
+		},
+		{
+			name:   "budget exhausted by repeated rate limits",
+			query:  "query { viewer { login } }",
+			budget: 10 * time.Second,
+			responses: []response{
+				{status: 429, header: map[string]string{"Retry-After": "4"}},
+				{status: 429, header: map[string]string{"Retry-After": "4"}},
+				{status: 429, header: map[string]string{"Retry-After": "4"}},
+				success,
+			},
+			requests:  3,
+			minWaited: 8 * time.Second,
+			rateLimit: true,
+		},
+		{
+			name:   "mutations are not retried",
+			query:  "mutation { addComment(input: {}) { clientMutationId } }",
+			budget: time.Minute,
+			responses: []response{
+				{status: 403, header: map[string]string{"Retry-After": "1"}, body: `{"message": "You have exceeded a secondary rate limit."}`},
+				success,
+			},
+			requests:  1,
+			rateLimit: true,
+		},
+		{
+			name:   "client errors are not retried",
+			query:  "query { viewer { login } }",
+			budget: time.Minute,
+			responses: []response{
+				{status: 401, body: `{"message": "Bad credentials"}`},
+				success,
+			},
+			requests: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				resp := test.responses[requests]
+				requests++
+				for k, v := range resp.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(resp.status)
+				fmt.Fprint(w, resp.body)
+			}))
+			defer server.Close()
+			client := newTestGitHubClient(server.URL)
+			client.retryBudget = test.budget
+
+			waited := time.Duration(0)
+			fakeTime(t, fakeNow, &waited)
+
+			err := client.graphql(test.query, nil, nil)
+
+			last := test.responses[requests-1]
+			switch {
+			case last.status == 200 && err != nil:
+				t.Errorf("expected nil error; got %s", err)
+			case last.status != 200 && err == nil:
+				t.Errorf("expected error; got nil")
+			}
+
+			var rl *rateLimitError
+			if errors.As(err, &rl) != test.rateLimit {
+				t.Errorf("expected rate limit error %v; got %v", test.rateLimit, err)
+			}
+			if isRateLimitErr(err) != test.rateLimit {
+				t.Errorf("expected isRateLimitErr to be %v for %v", test.rateLimit, err)
+			}
+
+			if requests != test.requests {
+				t.Errorf("expected %d requests; got %d", test.requests, requests)
+			}
+			if waited < test.minWaited {
+				t.Errorf("expected to wait at least %s; waited %s", test.minWaited, waited)
+			}
+			if waited > test.budget {
+				t.Errorf("expected to wait at most %s; waited %s", test.budget, waited)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		d := backoff(attempt)
+		max := time.Second << uint(attempt)
+		if max > 30*time.Second || max <= 0 {
+			max = 30 * time.Second
+		}
+		if d < max/2 || d > max {
+			t.Errorf("backoff(%d) = %s; want between %s and %s", attempt, d, max/2, max)
+		}
+	}
+}
+
+// fakeTime replaces the clock for the duration of the test, starting at start.
+// The total time slept is accumulated in waited.
+func fakeTime(t *testing.T, start time.Time, waited *time.Duration) {
+	originalNow, originalSleep := now, sleep
+	now = func() time.Time { return start.Add(*waited) }
+	sleep = func(d time.Duration) { *waited += d }
+	t.Cleanup(func() { now, sleep = originalNow, originalSleep })
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// redacted replaces secrets in dumps and error messages.
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders are the headers whose values are never dumped.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Private-Token",
+	"Proxy-Authorization",
+	"Set-Cookie",
+}
+
+// redact replaces every occurrence of the non-empty secrets in s.
+func redact(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+// redactedHeader returns a copy of h with the values of sensitive headers redacted.
+func redactedHeader(h http.Header) http.Header {
+	c := h.Clone()
+	for _, name := range sensitiveHeaders {
+		if _, ok := c[http.CanonicalHeaderKey(name)]; ok {
+			c.Set(name, redacted)
+		}
+	}
+	return c
+}
+
+// dumpRequest is like httputil.DumpRequestOut but redacts sensitive headers.
+func dumpRequest(req *http.Request) ([]byte, error) {
+	header := req.Header
+	req.Header = redactedHeader(header)
+	defer func() { req.Header = header }()
+	return httputil.DumpRequestOut(req, true)
+}
+
+// dumpResponse is like httputil.DumpResponse but redacts sensitive headers.
+func dumpResponse(resp *http.Response) ([]byte, error) {
+	header := resp.Header
+	resp.Header = redactedHeader(header)
+	defer func() { resp.Header = header }()
+	return httputil.DumpResponse(resp, true)
+}
+
+// redactedError is an error whose message has secrets redacted.
+type redactedError struct {
+	err     error
+	secrets []string
+}
+
+func (e *redactedError) Error() string {
+	return redact(e.err.Error(), e.secrets...)
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError returns an error with the same message as err, but with secrets redacted.
+// It returns nil if err is nil.
+func redactError(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{err: err, secrets: secrets}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		s        string
+		secrets  []string
+		expected string
+	}{
+		{s: "bearer abc", secrets: []string{"abc"}, expected: "bearer [REDACTED]"},
+		{s: "abc abc", secrets: []string{"abc"}, expected: "[REDACTED] [REDACTED]"},
+		{s: "abc def", secrets: []string{"abc", "def"}, expected: "[REDACTED] [REDACTED]"},
+		{s: "abc", secrets: []string{""}, expected: "abc"},
+		{s: "abc", secrets: nil, expected: "abc"},
+	}
+
+	for _, test := range tests {
+		if actual := redact(test.s, test.secrets...); actual != test.expected {
+			t.Errorf("redact(%q, %q) = %q; want %q", test.s, test.secrets, actual, test.expected)
+		}
+	}
+}
+
+func TestDumpRequest(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "https://api.github.com/graphql", bytes.NewBufferString("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "bearer secret-token")
+	req.Header.Set("Private-Token", "secret-token")
+	req.Header.Set("Accept", "application/json")
+
+	dump, err := dumpRequest(req)
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+
+	if strings.Contains(string(dump), "secret-token") {
+		t.Errorf("dump contains token:\n%s", dump)
+	}
+	for _, expected := range []string{"Authorization: [REDACTED]", "Private-Token: [REDACTED]", "Accept: application/json", "body"} {
+		if !strings.Contains(string(dump), expected) {
+			t.Errorf("expected dump to contain %q:\n%s", expected, dump)
+		}
+	}
+
+	if auth := req.Header.Get("Authorization"); auth != "bearer secret-token" {
+		t.Errorf("expected request header to be unchanged; got %q", auth)
+	}
+}
+
+func TestGraphqlErrorsNeverContainToken(t *testing.T) {
+	const token = "ghp_supersecrettoken"
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "non-200 response echoing the request",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Set-Cookie", "token="+token)
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintf(w, "bad credentials: %s", r.Header.Get("Authorization"))
+			},
+		},
+		{
+			name: "invalid json echoing the token",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "not json %s", r.Header.Get("Authorization"))
+			},
+		},
+		{
+			name: "graphql error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"errors": [{"message": "token %s is not allowed"}]}`, token)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(test.handler)
+			defer server.Close()
+			client := newTestGitHubClient(server.URL)
+			client.token = token
+			client.retryBudget = 0
+
+			err := client.graphql("query { viewer { login } }", nil, nil)
+			if err == nil {
+				t.Fatal("expected error; got nil")
+			}
+			if strings.Contains(err.Error(), token) {
+				t.Errorf("error contains token:\n%s", err)
+			}
+			if !strings.Contains(err.Error(), redacted) {
+				t.Errorf("expected error to contain %s:\n%s", redacted, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// restClient is a client for a JSON REST API.
+type restClient struct {
+	// url is the base URL of the API that request paths are relative to.
+	url string
+	// header is sent with every request (e.g. for authentication).
+	// Its values are redacted from errors.
+	header http.Header
+	// http sends requests to the API.
+	http *http.Client
+	// responsePrefix, if set, is stripped from response bodies before they are decoded
+	// (e.g. the )]}' line that Gerrit prepends to guard against XSSI).
+	responsePrefix string
+}
+
+// do sends a request with a JSON encoded body (if not nil) to the API,
+// decodes the JSON response into responseData (if not nil), and returns the response headers.
+// The path can also be an absolute URL, as returned by APIs for pagination.
+func (c *restClient) do(method, path string, body interface{}, responseData interface{}) (http.Header, error) {
+	header, err := c.doRest(method, path, body, responseData)
+	if err != nil {
+		// Errors end up in public logs, so make sure that they never contain credentials.
+		secrets := []string{}
+		for _, values := range c.header {
+			for _, v := range values {
+				secrets = append(secrets, v)
+				// Also redact the credential without its scheme (e.g. "Bearer").
+				if i := strings.LastIndex(v, " "); i >= 0 {
+					secrets = append(secrets, v[i+1:])
+				}
+			}
+		}
+		return nil, redactError(err, secrets...)
+	}
+	return header, nil
+}
+
+func (c *restClient) doRest(method, path string, body interface{}, responseData interface{}) (http.Header, error) {
+	reqbody := []byte{}
+	if body != nil {
+		var err error
+		reqbody, err = json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+	}
+
+	url := path
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		url = c.url + path
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(reqbody))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	reqdump, err := dumpRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("error dumping request: %w", err)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respdump, err := dumpResponse(resp)
+		if err != nil {
+			return nil, fmt.Errorf("error dumping response: %w", err)
+		}
+		return nil, &statusError{
+			statusCode: resp.StatusCode,
+			details:    fmt.Sprintf("%s\n\nrequest:\n%s", respdump, reqdump),
+		}
+	}
+
+	if responseData == nil {
+		return resp.Header, nil
+	}
+
+	respbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	respbody = bytes.TrimPrefix(respbody, []byte(c.responsePrefix))
+	if err := json.Unmarshal(respbody, responseData); err != nil {
+		return nil, fmt.Errorf("error decoding json response:\n%s\n%w", respbody, err)
+	}
+	return resp.Header, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// fakeComments is the state of the in-memory stand-ins for the REST APIs of code hosts:
+// the comments on a pull request, and the requests that were made.
+type fakeComments struct {
+	t *testing.T
+	// comments are the bodies of the comments on the pull request, oldest first.
+	// The id of a comment is its index plus one.
+	comments []string
+
+	// requests summarizes the requests that were made, in order.
+	requests []string
+}
+
+// request records a request.
+func (f *fakeComments) request(format string, args ...interface{}) {
+	f.requests = append(f.requests, fmt.Sprintf(format, args...))
+}
+
+// add adds a comment with body.
+func (f *fakeComments) add(body string) {
+	f.comments = append(f.comments, body)
+}
+
+// update replaces the body of the comment with id.
+func (f *fakeComments) update(id, body string) {
+	i, _ := strconv.Atoi(id)
+	f.comments[i-1] = body
+}
+
+// delete deletes the comment with id.
+func (f *fakeComments) delete(id string) {
+	i, _ := strconv.Atoi(id)
+	f.comments = append(f.comments[:i-1], f.comments[i:]...)
+}
+
+// decodeBody decodes the JSON body of r into v.
+func (f *fakeComments) decodeBody(r *http.Request, v interface{}) {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		f.t.Errorf("unable to decode request body: %s", err)
+	}
+}
+
+// unexpected fails the test for a request that the fake doesn't handle.
+func (f *fakeComments) unexpected(w http.ResponseWriter, r *http.Request) {
+	f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// serve starts a server for handler that is closed at the end of the test, and returns its URL.
+func serve(t *testing.T, handler http.Handler) string {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// fillerComments returns n comments that are not reports.
+func fillerComments(n int) []string {
+	comments := []string{}
+	for i := 0; i < n; i++ {
+		comments = append(comments, fmt.Sprintf("comment %d", i))
+	}
+	return comments
+}
+
+// commentTest is a case of commenting on a pull request through the REST API of a code host.
+type commentTest struct {
+	name string
+	opts func(o *options)
+	// comments are the comments on the pull request before and after commenting.
+	comments  []string
+	comments2 []string
+	notifs    map[string][]string
+	requests  []string
+}
+
+// runCommentTests comments on a pull request for each test, with the commenter that newCommenter returns
+// for a fake REST API that serves f.
+func runCommentTests(t *testing.T, tests []commentTest, newCommenter func(t *testing.T, f *fakeComments) commenter) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &fakeComments{t: t, comments: append([]string{}, test.comments...)}
+			c := newCommenter(t, f)
+
+			o := options{filename: "CODENOTIFY", format: "markdown", baseRef: "a", headRef: "b"}
+			if test.opts != nil {
+				test.opts(&o)
+			}
+			if err := commentOn(&o, c)(test.notifs); err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+
+			if !reflect.DeepEqual(test.requests, f.requests) {
+				t.Errorf("expected requests %q; got %q", test.requests, f.requests)
+			}
+			if !reflect.DeepEqual(test.comments2, f.comments) {
+				t.Errorf("expected comments:\n%q\ngot:\n%q", test.comments2, f.comments)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Values for options.rulesFrom, which is the revision whose notify files define the rules.
+const (
+	// rulesFromBase reads rules from the base revision, so that a pull request can't change who
+	// is notified about it. This is the safe choice for workflows that run with write access
+	// on pull requests from forks (e.g. pull_request_target).
+	rulesFromBase = "base"
+	// rulesFromHead reads rules from the head revision.
+	rulesFromHead = "head"
+	// rulesFromUnion reads rules from both revisions, and flags the subscriptions that only come from the head.
+	rulesFromUnion = "union"
+)
+
+// parseRulesFrom validates the value of the option name for the revision of rules, which defaults to rulesFromBase.
+func parseRulesFrom(name, value string) (string, error) {
+	switch value {
+	case "":
+		return rulesFromBase, nil
+	case rulesFromBase, rulesFromHead, rulesFromUnion:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid value for %s: %s", name, value)
+}
+
+// ruleSet is the rules in the notify files of one revision, or the union of the rules of two revisions.
+type ruleSet struct {
+	// fss are the file systems of the revisions, base first.
+	fss      []FS
+	filename string
+}
+
+// baseFS returns the files of the base revision of the diff.
+func (o *options) baseFS() FS {
+	if o.rulesDir != "" {
+		return &worktreefs{root: o.rulesDir}
+	}
+	return &gitfs{cwd: o.cwd, rev: o.baseRef}
+}
+
+// headFS returns the files of the head revision of the diff, which are the staged files
+// or the files in the working tree in local modes.
+func (o *options) headFS() FS {
+	if o.rulesDir != "" {
+		return &worktreefs{root: o.rulesDir}
+	}
+	switch o.local {
+	case localStaged:
+		return &gitfs{cwd: o.cwd}
+	case localWorktree:
+		return &worktreefs{cwd: o.cwd}
+	}
+	return &gitfs{cwd: o.cwd, rev: o.headRef}
+}
+
+// ruleSet returns the rules of the revisions that o reads rules from.
+func (o *options) ruleSet() ruleSet {
+	base, head := o.baseFS(), o.headFS()
+	switch o.rulesFrom {
+	case rulesFromHead:
+		return ruleSet{fss: []FS{head}, filename: o.filename}
+	case rulesFromUnion:
+		return ruleSet{fss: []FS{base, head}, filename: o.filename}
+	default:
+		return ruleSet{fss: []FS{base}, filename: o.filename}
+	}
+}
+
+// notifications returns the notifications for paths. For the union of two revisions, subscribers are
+// notified about the files of both with their strongest mode, added is the set of handles that
+// are only subscribers (or only have their mode) because of the head revision, and addedFiles are
+// the files that the other handles are only notified about because of the head revision.
+func (r ruleSet) notifications(paths []string) (notifs map[string][]string, added map[string]bool, addedFiles map[string]map[string]bool, err error) {
+	notifs, err = notifications(r.fss[0], paths, r.filename)
+	if err != nil || len(r.fss) == 1 {
+		return notifs, nil, nil, err
+	}
+
+	head, err := notifications(r.fss[1], paths, r.filename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	added, addedFiles = addedSubscribers(notifs, head)
+	return mergeNotifications(paths, notifs, head), added, addedFiles, nil
+}
+
+// labels returns the sorted, deduplicated labels of the rules that match any of the paths.
+func (r ruleSet) labels(paths []string) ([]string, error) {
+	seen := map[string]bool{}
+	all := []string{}
+	for _, fs := range r.fss {
+		l, err := labels(fs, paths, r.filename)
+		if err != nil {
+			return nil, err
+		}
+		for _, label := range l {
+			if !seen[label] {
+				seen[label] = true
+				all = append(all, label)
+			}
+		}
+	}
+	sort.Strings(all)
+	return all, nil
+}
+
+// provenance returns the rules that subscribe each handle to each of the paths.
+// Rules that are the same in both revisions are only included once.
+func (r ruleSet) provenance(paths []string) (map[string]map[string][]rule, error) {
+	all := map[string]map[string][]rule{}
+	for _, fs := range r.fss {
+		p, err := provenance(fs, paths, r.filename)
+		if err != nil {
+			return nil, err
+		}
+		for handle, files := range p {
+			if all[handle] == nil {
+				all[handle] = map[string][]rule{}
+			}
+			for path, rules := range files {
+				for _, rule := range rules {
+					if !containsRule(all[handle][path], rule) {
+						all[handle][path] = append(all[handle][path], rule)
+					}
+				}
+			}
+		}
+	}
+	return all, nil
+}
+
+func containsRule(rules []rule, r rule) bool {
+	for _, existing := range rules {
+		if existing.file == r.file && existing.line == r.line && existing.pattern == r.pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeNotifications returns the union of notifications for paths, in which each subscriber
+// has the files of both in the order of paths and the strongest of their modes.
+func mergeNotifications(paths []string, a, b map[string][]string) map[string][]string {
+	files := map[string]map[string]bool{}
+	modes := map[string]notifyMode{}
+	for _, notifs := range []map[string][]string{a, b} {
+		for sub, f := range notifs {
+			handle, mode := splitSubscriber(sub)
+			if m, ok := modes[handle]; !ok || mode.rank() > m.rank() {
+				modes[handle] = mode
+			}
+			if files[handle] == nil {
+				files[handle] = map[string]bool{}
+			}
+			for _, path := range f {
+				files[handle][path] = true
+			}
+		}
+	}
+
+	merged := map[string][]string{}
+	for handle, f := range files {
+		sub := handle
+		if mode := modes[handle]; mode != modeMention {
+			sub += ":" + string(mode)
+		}
+		for _, path := range paths {
+			if f[path] {
+				merged[sub] = append(merged[sub], path)
+			}
+		}
+	}
+	return merged
+}
+
+// addedSubscribers returns the handles that are subscribers in head but not in base,
+// or that have a stronger mode in head. For the other handles, files are the files that
+// they are subscribed to in head but not in base.
+func addedSubscribers(base, head map[string][]string) (handles map[string]bool, files map[string]map[string]bool) {
+	modes := map[string]notifyMode{}
+	baseFiles := map[string]map[string]bool{}
+	for sub, f := range base {
+		handle, mode := splitSubscriber(sub)
+		modes[handle] = mode
+		baseFiles[handle] = map[string]bool{}
+		for _, path := range f {
+			baseFiles[handle][path] = true
+		}
+	}
+
+	handles = map[string]bool{}
+	files = map[string]map[string]bool{}
+	for sub, f := range head {
+		handle, mode := splitSubscriber(sub)
+		if m, ok := modes[handle]; !ok || mode.rank() > m.rank() {
+			handles[handle] = true
+			continue
+		}
+		for _, path := range f {
+			if !baseFiles[handle][path] {
+				if files[handle] == nil {
+					files[handle] = map[string]bool{}
+				}
+				files[handle][path] = true
+			}
+		}
+	}
+	return handles, files
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRuleSetUnion(t *testing.T) {
+	base := memfs{
+		"CODENOTIFY":     "**/*.go @go\n*.md @docs:silent\n",
+		"web/index.js":   "",
+		"README.md":      "",
+		"cmd/main.go":    "",
+		"web/CODENOTIFY": "",
+	}
+	head := memfs{
+		"CODENOTIFY":     "**/*.go @go\n*.md @docs:review label=docs\n",
+		"web/CODENOTIFY": "** @web\n** @go\n",
+	}
+	paths := []string{"README.md", "cmd/main.go", "web/index.js"}
+	rules := ruleSet{fss: []FS{base, head}, filename: "CODENOTIFY"}
+
+	notifs, added, addedFiles, err := rules.notifications(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedNotifs := map[string][]string{
+		"@go":          {"cmd/main.go", "web/index.js"},
+		"@docs:review": {"README.md"},
+		"@web":         {"web/index.js"},
+	}
+	if !reflect.DeepEqual(expectedNotifs, notifs) {
+		t.Errorf("expected notifications %v; got %v", expectedNotifs, notifs)
+	}
+	// @go was already a subscriber, but @docs is now requested to review.
+	expectedAdded := map[string]bool{"@docs": true, "@web": true}
+	if !reflect.DeepEqual(expectedAdded, added) {
+		t.Errorf("expected added subscribers %v; got %v", expectedAdded, added)
+	}
+	// @go was already notified about cmd/main.go, but not about web/index.js.
+	expectedFiles := map[string]map[string]bool{"@go": {"web/index.js": true}}
+	if !reflect.DeepEqual(expectedFiles, addedFiles) {
+		t.Errorf("expected added files %v; got %v", expectedFiles, addedFiles)
+	}
+
+	labels, err := rules.labels(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{"docs"}, labels) {
+		t.Errorf("expected labels [docs]; got %v", labels)
+	}
+
+	prov, err := rules.provenance(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(prov["@go"]["cmd/main.go"]); n != 1 {
+		t.Errorf("expected the same rule in both revisions once; got %d rules", n)
+	}
+	if rules := prov["@go"]["web/index.js"]; len(rules) != 1 || rules[0].file != "web/CODENOTIFY" {
+		t.Errorf("expected the rule of the head revision for web/index.js; got %+v", rules)
+	}
+}
+
+func TestRuleSetSingle(t *testing.T) {
+	fs := memfs{"CODENOTIFY": "** @all\n"}
+	notifs, added, addedFiles, err := ruleSet{fss: []FS{fs}, filename: "CODENOTIFY"}.notifications([]string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(map[string][]string{"@all": {"a"}}, notifs) || added != nil || addedFiles != nil {
+		t.Errorf("unexpected notifications %v, added subscribers %v and added files %v", notifs, added, addedFiles)
+	}
+}
+
+func TestRuleSetUnionNewPath(t *testing.T) {
+	base := memfs{
+		"CODENOTIFY": "a.go @alice\n",
+		"a.go":       "",
+		"b.go":       "",
+	}
+	head := memfs{"CODENOTIFY": "a.go @alice\nb.go @alice\n"}
+	rules := ruleSet{fss: []FS{base, head}, filename: "CODENOTIFY"}
+
+	notifs, added, addedFiles, err := rules.notifications([]string{"a.go", "b.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string][]string{"@alice": {"a.go", "b.go"}}; !reflect.DeepEqual(expected, notifs) {
+		t.Errorf("expected notifications %v; got %v", expected, notifs)
+	}
+	if len(added) != 0 {
+		t.Errorf("expected no added subscribers; got %v", added)
+	}
+	if expected := map[string]map[string]bool{"@alice": {"b.go": true}}; !reflect.DeepEqual(expected, addedFiles) {
+		t.Errorf("expected added files %v; got %v", expected, addedFiles)
+	}
+
+	o := options{filename: "CODENOTIFY", format: "text", baseRef: "a", headRef: "b", addedByPullRequest: added, filesAddedByPullRequest: addedFiles}
+	buf := bytes.Buffer{}
+	if err := o.writeNotifications(&buf, notifs); err != nil {
+		t.Fatal(err)
+	}
+	if expected := joinLines([]string{"a...b", "@alice -> a.go, b.go (from this pull request)"}); buf.String() != expected {
+		t.Errorf("\nwant: %q\n got: %q", expected, buf.String())
+	}
+}
+
+func TestWriteNotificationsFromPullRequest(t *testing.T) {
+	notifs := map[string][]string{"@go": {"main.go"}, "@web:review": {"web/index.js"}}
+	tests := []struct {
+		format string
+		output []string
+	}{
+		{
+			format: "text",
+			output: []string{
+				"a...b",
+				"@go -> main.go",
+				"@web (review) (from this pull request) -> web/index.js",
+			},
+		},
+		{
+			format: "markdown",
+			output: []string{
+				"<!-- codenotify:CODENOTIFY report -->",
+				"[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff a...b.",
+				"",
+				"| Notify | File(s) |",
+				"|-|-|",
+				"| @go | main.go |",
+				"| @web (review) (from this pull request) | web/index.js |",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			o := options{
+				filename:           "CODENOTIFY",
+				format:             test.format,
+				baseRef:            "a",
+				headRef:            "b",
+				addedByPullRequest: map[string]bool{"@web": true},
+			}
+			buf := bytes.Buffer{}
+			if err := o.writeNotifications(&buf, notifs); err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if expected := joinLines(test.output); buf.String() != expected {
+				t.Errorf("\nwant: %q\n got: %q", expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestParseRulesFrom(t *testing.T) {
+	for value, want := range map[string]string{"": rulesFromBase, "base": rulesFromBase, "head": rulesFromHead, "union": rulesFromUnion} {
+		if got, err := parseRulesFrom("-rules-from", value); err != nil || got != want {
+			t.Errorf("expected %q for %q; got %q, %v", want, value, got, err)
+		}
+	}
+	if _, err := parseRulesFrom("-rules-from", "merge"); err == nil || err.Error() != "invalid value for -rules-from: merge" {
+		t.Errorf("expected invalid value error; got %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// slackMaxFiles is the maximum number of files listed per subscriber in a Slack message.
+const slackMaxFiles = 10
+
+// slackConfig configures the Slack notifications of a run.
+type slackConfig struct {
+	// apiURL is the URL of the Slack Web API (e.g. https://slack.com/api).
+	apiURL string
+	// token is a bot token with the chat:write scope.
+	token string
+	// webhook is the URL of an incoming webhook, which can be used instead of a bot token
+	// to post (but not update) messages in the webhook's channel.
+	webhook string
+	// mapping is the path of a file that maps handles to Slack user IDs (U...) or user group IDs (S...).
+	mapping string
+	// channel is the channel to post a message to.
+	channel string
+	// dm sends each mapped subscriber a direct message instead.
+	dm bool
+	// state is the path of a file that records posted messages so that they can be updated.
+	state string
+}
+
+// enabled returns true if Slack notifications are configured.
+func (c *slackConfig) enabled() bool {
+	return c.webhook != "" || c.channel != "" || c.dm
+}
+
+// slackConfigFromEnv returns the Slack configuration from the env vars of n.
+func slackConfigFromEnv(n envNaming) (slackConfig, error) {
+	c := slackConfig{
+		apiURL:  "https://slack.com/api",
+		token:   n.get("slack-token"),
+		webhook: n.get("slack-webhook"),
+		mapping: n.get("slack-mapping"),
+		channel: n.get("slack-channel"),
+		state:   n.get("slack-state"),
+	}
+	if dm := n.get("slack-dm"); dm != "" {
+		var err error
+		c.dm, err = strconv.ParseBool(dm)
+		if err != nil {
+			return c, fmt.Errorf("invalid value for %s: %s", n.describe("slack-dm"), dm)
+		}
+	}
+	return c, nil
+}
+
+// addSlackFromEnv adds Slack notifications to o if they are configured by the env vars of n.
+func addSlackFromEnv(o *options, n envNaming) error {
+	config, err := slackConfigFromEnv(n)
+	if err != nil || !config.enabled() {
+		return err
+	}
+
+	print, err := notifySlack(o, config)
+	if err != nil {
+		return err
+	}
+	o.addPrint(print)
+	return nil
+}
+
+// slackTarget identifies a posted message.
+type slackTarget struct {
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// slackState maps the key of a pull request to the messages posted about it,
+// keyed by the channel or user that they were posted to.
+type slackState map[string]map[string]slackTarget
+
+// slackNotifier posts notifications to Slack.
+type slackNotifier struct {
+	config  slackConfig
+	client  *restClient
+	mapping map[string]string
+}
+
+// notifySlack returns a print function that posts notifications to Slack.
+func notifySlack(o *options, config slackConfig) (func(map[string][]string) error, error) {
+	switch {
+	case config.webhook != "" && (config.token != "" || config.dm):
+		return nil, fmt.Errorf("a Slack webhook can not be used with a bot token or direct messages")
+	case config.webhook == "" && config.token == "":
+		return nil, fmt.Errorf("a Slack bot token or webhook is required")
+	case config.token != "" && config.channel == "" && !config.dm:
+		return nil, fmt.Errorf("a Slack channel or direct messages are required with a bot token")
+	}
+
+	s := &slackNotifier{config: config, mapping: map[string]string{}}
+	if config.mapping != "" {
+		var err error
+		s.mapping, err = readMapping(config.mapping)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.token != "" {
+		s.client = &restClient{
+			url:    config.apiURL,
+			header: http.Header{"Authorization": {"Bearer " + config.token}},
+			http:   &http.Client{},
+		}
+	}
+
+	return func(notifs map[string][]string) error {
+		if config.webhook != "" {
+			return s.postWebhook(o, notifs)
+		}
+		return s.post(o, notifs)
+	}, nil
+}
+
+// postWebhook posts a message to the incoming webhook.
+func (s *slackNotifier) postWebhook(o *options, notifs map[string][]string) error {
+	if len(notifs) == 0 {
+		fmt.Fprintln(verbose, "not posting to Slack because there are no notifications to send")
+		return nil
+	}
+
+	fmt.Fprintln(verbose, "posting to Slack webhook")
+	client := &restClient{url: s.config.webhook, http: &http.Client{}}
+	if _, err := client.do(http.MethodPost, "", map[string]string{"text": s.channelMessage(o, notifs)}, nil); err != nil {
+		// The path of the webhook URL is a secret, and request dumps contain it without the host.
+		secrets := []string{s.config.webhook}
+		if u, err := url.Parse(s.config.webhook); err == nil && u.Path != "" && u.Path != "/" {
+			secrets = append(secrets, u.Path)
+		}
+		return redactError(err, secrets...)
+	}
+	return nil
+}
+
+// post posts or updates a message in the channel, or a direct message to each subscriber.
+func (s *slackNotifier) post(o *options, notifs map[string][]string) error {
+	state, err := s.readState()
+	if err != nil {
+		return err
+	}
+
+	key := slackKey(o)
+	targets := state[key]
+	if targets == nil {
+		targets = map[string]slackTarget{}
+	}
+
+	messages := map[string]string{}
+	if s.config.dm {
+		for sub, files := range notifs {
+			handle, mode := splitSubscriber(sub)
+			id := s.mapping[handle]
+			if o.exceedsThreshold(notifs) || mode == modeSilent || !strings.HasPrefix(id, "U") {
+				fmt.Fprintf(verbose, "not sending a Slack direct message to %s\n", handle)
+				continue
+			}
+			messages[id] = s.directMessage(o, files)
+		}
+		// Update previous direct messages to subscribers who are no longer notified,
+		// or to all of them if the threshold is exceeded.
+		stale := s.header(o) + "\nNo notifications."
+		if o.exceedsThreshold(notifs) {
+			stale = s.channelMessage(o, notifs)
+		}
+		for id := range targets {
+			if _, ok := messages[id]; !ok {
+				messages[id] = stale
+			}
+		}
+	} else if len(notifs) > 0 || targets[s.config.channel] != (slackTarget{}) {
+		messages[s.config.channel] = s.channelMessage(o, notifs)
+	}
+
+	ids := make([]string, 0, len(messages))
+	for id := range messages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		target, err := s.upsert(targets[id], id, messages[id])
+		if err != nil {
+			return err
+		}
+		targets[id] = target
+	}
+
+	if len(ids) == 0 {
+		fmt.Fprintln(verbose, "not posting to Slack because there are no notifications to send")
+		return nil
+	}
+	state[key] = targets
+	return s.writeState(state)
+}
+
+// upsert updates the message of target, or posts a new one to the channel (or user) id if target is empty.
+func (s *slackNotifier) upsert(target slackTarget, id, text string) (slackTarget, error) {
+	method := "/chat.postMessage"
+	body := map[string]string{"channel": id, "text": text}
+	if target != (slackTarget{}) {
+		fmt.Fprintf(verbose, "updating Slack message %s in %s\n", target.TS, target.Channel)
+		method = "/chat.update"
+		body = map[string]string{"channel": target.Channel, "ts": target.TS, "text": text}
+	} else {
+		fmt.Fprintf(verbose, "posting Slack message to %s\n", id)
+	}
+
+	resp := struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		slackTarget
+	}{}
+	if _, err := s.client.do(http.MethodPost, method, body, &resp); err != nil {
+		return target, err
+	}
+	if !resp.OK {
+		return target, fmt.Errorf("error calling Slack %s: %s", strings.TrimPrefix(method, "/"), resp.Error)
+	}
+	return resp.slackTarget, nil
+}
+
+// slackKey identifies the pull request in the Slack state.
+func slackKey(o *options) string {
+	if o.url != "" {
+		return o.url
+	}
+	return o.diff()
+}
+
+func (s *slackNotifier) readState() (slackState, error) {
+	state := slackState{}
+	if s.config.state == "" {
+		return state, nil
+	}
+
+	data, err := ioutil.ReadFile(s.config.state)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read Slack state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("unable to decode Slack state %s: %w", s.config.state, err)
+	}
+	return state, nil
+}
+
+func (s *slackNotifier) writeState(state slackState) error {
+	if s.config.state == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.config.state, data, 0644); err != nil {
+		return fmt.Errorf("unable to write Slack state: %w", err)
+	}
+	return nil
+}
+
+// header returns the first line of a message, which links to the pull request if its URL is known.
+func (s *slackNotifier) header(o *options) string {
+	diff := o.diff()
+	if o.url != "" {
+		diff = "<" + o.url + "|" + diff + ">"
+	}
+	return fmt.Sprintf("*Codenotify*: subscribers in %s files for %s", o.filename, diff)
+}
+
+// channelMessage lists all subscribers and their files.
+func (s *slackNotifier) channelMessage(o *options, notifs map[string][]string) string {
+	lines := []string{s.header(o)}
+	switch {
+	case o.exceedsThreshold(notifs):
+		lines = append(lines, fmt.Sprintf("Not notifying subscribers because the number of notifying subscribers (%d) has exceeded the threshold (%d).", len(notifs), o.subscriberThreshold))
+	case len(notifs) == 0:
+		lines = append(lines, "No notifications.")
+	default:
+		subs := make([]string, 0, len(notifs))
+		for sub := range notifs {
+			subs = append(subs, sub)
+		}
+		sort.Strings(subs)
+		for _, sub := range subs {
+			lines = append(lines, fmt.Sprintf("• %s: %s", s.subscriber(sub), slackFiles(notifs[sub])))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// directMessage lists the files of a single subscriber.
+func (s *slackNotifier) directMessage(o *options, files []string) string {
+	return s.header(o) + "\nYou are subscribed to " + slackFiles(files)
+}
+
+// subscriber formats a subscriber, mentioning them if their handle is mapped to a Slack ID.
+func (s *slackNotifier) subscriber(sub string) string {
+	handle, mode := splitSubscriber(sub)
+	text := slackEscape(handle)
+	if id := s.mapping[handle]; id != "" && mode != modeSilent {
+		if strings.HasPrefix(id, "S") {
+			text = "<!subteam^" + id + ">"
+		} else {
+			text = "<@" + id + ">"
+		}
+	}
+	if mode != modeMention {
+		text += " (" + string(mode) + ")"
+	}
+	return text
+}
+
+// slackFiles formats a list of files, truncated to slackMaxFiles.
+func slackFiles(files []string) string {
+	formatted := []string{}
+	for i, file := range files {
+		if i == slackMaxFiles {
+			formatted = append(formatted, fmt.Sprintf("and %d more", len(files)-i))
+			break
+		}
+		formatted = append(formatted, "`"+slackEscape(file)+"`")
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// slackEscape escapes the characters that have a special meaning in Slack messages.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNotifySlackChannel(t *testing.T) {
+	slack := &fakeSlack{t: t}
+	server := httptest.NewServer(slack)
+	defer server.Close()
+
+	dir := t.TempDir()
+	mapping := filepath.Join(dir, "slack-mapping")
+	writeFile(t, mapping, "# handle slack-id\n@alice U1\n@web S1\n@lead U2\n")
+	config := slackConfig{
+		apiURL:  server.URL,
+		token:   "xoxb-test",
+		mapping: mapping,
+		channel: "C1",
+		state:   filepath.Join(dir, "state.json"),
+	}
+	o := &options{filename: "CODENOTIFY", baseRef: "a", headRef: "b", url: "https://github.com/o/r/pull/1"}
+	print, err := notifySlack(o, config)
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+
+	if err := print(map[string][]string{
+		"@alice":       {"a.go", "b<c>.go"},
+		"@web:review":  {"web/index.js"},
+		"@lead:silent": {"a.go"},
+		"@bob":         {"b.go"},
+	}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+
+	header := "*Codenotify*: subscribers in CODENOTIFY files for <https://github.com/o/r/pull/1|a...b>"
+	expected := []fakeSlackMessage{{
+		Method:  "chat.postMessage",
+		Channel: "C1",
+		Text: strings.Join([]string{
+			header,
+			"• <@U1>: `a.go`, `b&lt;c&gt;.go`",
+			"• @bob: `b.go`",
+			"• @lead (silent): `a.go`",
+			"• <!subteam^S1> (review): `web/index.js`",
+		}, "\n"),
+	}}
+	if !reflect.DeepEqual(expected, slack.messages) {
+		t.Fatalf("expected messages:\n%+v\ngot:\n%+v", expected, slack.messages)
+	}
+
+	// The message is updated on the next run.
+	slack.messages = nil
+	if err := print(map[string][]string{}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	expected = []fakeSlackMessage{{Method: "chat.update", Channel: "C1", TS: "1.000001", Text: header + "\nNo notifications."}}
+	if !reflect.DeepEqual(expected, slack.messages) {
+		t.Errorf("expected messages:\n%+v\ngot:\n%+v", expected, slack.messages)
+	}
+}
+
+func TestNotifySlackSkip(t *testing.T) {
+	slack := &fakeSlack{t: t}
+	server := httptest.NewServer(slack)
+	defer server.Close()
+
+	config := slackConfig{apiURL: server.URL, token: "xoxb-test", channel: "C1"}
+	print, err := notifySlack(&options{}, config)
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if err := print(map[string][]string{}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if len(slack.messages) != 0 {
+		t.Errorf("expected no messages; got %+v", slack.messages)
+	}
+}
+
+func TestNotifySlackDirectMessages(t *testing.T) {
+	slack := &fakeSlack{t: t}
+	server := httptest.NewServer(slack)
+	defer server.Close()
+
+	dir := t.TempDir()
+	mapping := filepath.Join(dir, "slack-mapping")
+	writeFile(t, mapping, "@alice U1\n@bob U2\n@web S1\n@lead U3\n")
+	config := slackConfig{
+		apiURL:  server.URL,
+		token:   "xoxb-test",
+		mapping: mapping,
+		dm:      true,
+		state:   filepath.Join(dir, "state.json"),
+	}
+	o := &options{filename: "CODENOTIFY", baseRef: "a", headRef: "b"}
+	print, err := notifySlack(o, config)
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+
+	files := make([]string, 12)
+	for i := range files {
+		files[i] = fmt.Sprintf("%d.go", i)
+	}
+	if err := print(map[string][]string{
+		"@alice":       {"a.go"},
+		"@bob":         files,
+		"@web":         {"web/index.js"},
+		"@lead:silent": {"a.go"},
+		"@carol":       {"c.go"},
+	}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+
+	header := "*Codenotify*: subscribers in CODENOTIFY files for a...b"
+	expected := []fakeSlackMessage{
+		{Method: "chat.postMessage", Channel: "U1", Text: header + "\nYou are subscribed to `a.go`"},
+		{Method: "chat.postMessage", Channel: "U2", Text: header + "\nYou are subscribed to `0.go`, `1.go`, `2.go`, `3.go`, `4.go`, `5.go`, `6.go`, `7.go`, `8.go`, `9.go`, and 2 more"},
+	}
+	if !reflect.DeepEqual(expected, slack.messages) {
+		t.Fatalf("expected messages:\n%+v\ngot:\n%+v", expected, slack.messages)
+	}
+
+	// Direct messages to subscribers who are no longer notified are updated.
+	slack.messages = nil
+	if err := print(map[string][]string{"@alice": {"a.go", "b.go"}}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	expected = []fakeSlackMessage{
+		{Method: "chat.update", Channel: "D-U1", TS: "1.000001", Text: header + "\nYou are subscribed to `a.go`, `b.go`"},
+		{Method: "chat.update", Channel: "D-U2", TS: "1.000002", Text: header + "\nNo notifications."},
+	}
+	if !reflect.DeepEqual(expected, slack.messages) {
+		t.Errorf("expected messages:\n%+v\ngot:\n%+v", expected, slack.messages)
+	}
+
+	// If the threshold is exceeded, previous direct messages say so.
+	slack.messages = nil
+	o.subscriberThreshold = 1
+	if err := print(map[string][]string{"@alice": {"a.go"}, "@bob": {"b.go"}}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	exceeded := header + "\nNot notifying subscribers because the number of notifying subscribers (2) has exceeded the threshold (1)."
+	expected = []fakeSlackMessage{
+		{Method: "chat.update", Channel: "D-U1", TS: "1.000001", Text: exceeded},
+		{Method: "chat.update", Channel: "D-U2", TS: "1.000002", Text: exceeded},
+	}
+	if !reflect.DeepEqual(expected, slack.messages) {
+		t.Errorf("expected messages:\n%+v\ngot:\n%+v", expected, slack.messages)
+	}
+}
+
+func TestNotifySlackError(t *testing.T) {
+	slack := &fakeSlack{t: t}
+	server := httptest.NewServer(slack)
+	defer server.Close()
+
+	config := slackConfig{apiURL: server.URL, token: "xoxb-test", channel: "C-archived"}
+	print, err := notifySlack(&options{}, config)
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	err = print(map[string][]string{"@alice": {"a.go"}})
+	if err == nil || err.Error() != "error calling Slack chat.postMessage: is_archived" {
+		t.Errorf("expected is_archived error; got %v", err)
+	}
+
+	config.token = "xoxb-wrong"
+	print, err = notifySlack(&options{}, config)
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	err = print(map[string][]string{"@alice": {"a.go"}})
+	if err == nil {
+		t.Fatal("expected error for invalid token")
+	}
+	if strings.Contains(err.Error(), "xoxb-wrong") {
+		t.Errorf("expected token to be redacted from error:\n%s", err)
+	}
+}
+
+func TestNotifySlackWebhook(t *testing.T) {
+	var texts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/services/T1/B1/secret" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "invalid_token")
+			return
+		}
+		body := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("unable to decode request body: %s", err)
+		}
+		texts = append(texts, body["text"])
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	o := &options{filename: "CODENOTIFY", baseRef: "a", headRef: "b"}
+	print, err := notifySlack(o, slackConfig{webhook: server.URL + "/services/T1/B1/secret", channel: "ignored"})
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if err := print(map[string][]string{}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if err := print(map[string][]string{"@alice": {"a.go"}}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	expected := []string{"*Codenotify*: subscribers in CODENOTIFY files for a...b\n• @alice: `a.go`"}
+	if !reflect.DeepEqual(expected, texts) {
+		t.Errorf("expected texts %q; got %q", expected, texts)
+	}
+
+	webhook := server.URL + "/services/T1/B1/wrong"
+	print, err = notifySlack(o, slackConfig{webhook: webhook})
+	if err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	err = print(map[string][]string{"@alice": {"a.go"}})
+	if err == nil {
+		t.Fatal("expected error for invalid webhook")
+	}
+	if strings.Contains(err.Error(), "/services/T1/B1/wrong") {
+		t.Errorf("expected webhook URL to be redacted from error:\n%s", err)
+	}
+}
+
+func TestNotifySlackConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config slackConfig
+		err    string
+	}{
+		{
+			name:   "webhook and token",
+			config: slackConfig{webhook: "https://hooks.slack.com/x", token: "xoxb-test"},
+			err:    "a Slack webhook can not be used with a bot token or direct messages",
+		},
+		{
+			name:   "webhook and direct messages",
+			config: slackConfig{webhook: "https://hooks.slack.com/x", dm: true},
+			err:    "a Slack webhook can not be used with a bot token or direct messages",
+		},
+		{
+			name:   "no credentials",
+			config: slackConfig{channel: "C1"},
+			err:    "a Slack bot token or webhook is required",
+		},
+		{
+			name:   "no destination",
+			config: slackConfig{token: "xoxb-test"},
+			err:    "a Slack channel or direct messages are required with a bot token",
+		},
+		{
+			name:   "missing mapping",
+			config: slackConfig{token: "xoxb-test", channel: "C1", mapping: "does-not-exist"},
+			err:    "unable to read mapping file: open does-not-exist: no such file or directory",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := notifySlack(&options{}, test.config)
+			if err == nil || err.Error() != test.err {
+				t.Errorf("expected error %q; got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeSlackMessage records a call to post or update a message.
+type fakeSlackMessage struct {
+	Method  string
+	Channel string
+	TS      string
+	Text    string
+}
+
+// fakeSlack is an in-memory stand-in for the parts of the Slack Web API that codenotify uses.
+type fakeSlack struct {
+	t *testing.T
+	// messages are the messages that were posted or updated, in order.
+	messages []fakeSlackMessage
+	// posted is the number of messages that were posted.
+	posted int
+}
+
+func (f *fakeSlack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body := struct {
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+		Text    string `json:"text"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		f.t.Errorf("unable to decode request body: %s", err)
+	}
+
+	method := strings.TrimPrefix(r.URL.Path, "/")
+	f.messages = append(f.messages, fakeSlackMessage{Method: method, Channel: body.Channel, TS: body.TS, Text: body.Text})
+
+	// Slack reports errors in the body of successful responses.
+	resp := map[string]interface{}{"ok": true, "channel": body.Channel, "ts": body.TS}
+	switch {
+	case body.Channel == "C-archived":
+		resp = map[string]interface{}{"ok": false, "error": "is_archived"}
+	case method == "chat.postMessage":
+		f.posted++
+		resp["ts"] = fmt.Sprintf("1.%06d", f.posted)
+		if strings.HasPrefix(body.Channel, "U") {
+			// Direct messages are posted to the channel of the conversation with the user.
+			resp["channel"] = "D-" + body.Channel
+		}
+	case method == "chat.update":
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
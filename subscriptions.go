@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Values for options.subscriptionChanges, which is what happens when a diff changes notify files.
+const (
+	// subscriptionChangesOff ignores changes to notify files.
+	subscriptionChangesOff = "off"
+	// subscriptionChangesReport lists the subscribers that were added to or removed from patterns in the report.
+	subscriptionChangesReport = "report"
+	// subscriptionChangesNotify also notifies removed subscribers about the notify file that removed them.
+	subscriptionChangesNotify = "notify"
+)
+
+// parseSubscriptionChanges validates the value of the option name for changes to notify files,
+// which defaults to subscriptionChangesOff.
+func parseSubscriptionChanges(name, value string) (string, error) {
+	switch value {
+	case "":
+		return subscriptionChangesOff, nil
+	case subscriptionChangesOff, subscriptionChangesReport, subscriptionChangesNotify:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid value for %s: %s", name, value)
+}
+
+// subscriptionChange is a subscriber that a diff adds to or removes from a pattern in a notify file.
+type subscriptionChange struct {
+	// file is the path of the notify file.
+	file    string
+	pattern string
+	// subscriber is the subscriber with its mode (e.g. @alice:silent).
+	subscriber string
+	added      bool
+	// err, if set, is why the head revision of the notify file can't be read, in which case
+	// there is no pattern or subscriber.
+	err error
+}
+
+// subscriptionChanges returns the subscribers that are added to or removed from the patterns of the
+// notify files in paths, in the order of paths. Removed subscribers of a notify file come before added ones.
+// A notify file that is invalid in head is a change with an error, so that a diff can't fail the report.
+func subscriptionChanges(base, head FS, paths []string, notifyFilename string) ([]subscriptionChange, error) {
+	changes := []subscriptionChange{}
+	for _, p := range paths {
+		if path.Base(p) != notifyFilename {
+			continue
+		}
+
+		baseRules, err := readRules(base, p)
+		if err != nil && err != os.ErrNotExist {
+			return nil, err
+		}
+		headRules, err := readRules(head, p)
+		if err != nil && err != os.ErrNotExist {
+			changes = append(changes, subscriptionChange{file: p, err: err})
+			continue
+		}
+
+		changes = append(changes, diffRules(p, baseRules, headRules, false)...)
+		changes = append(changes, diffRules(p, headRules, baseRules, true)...)
+	}
+	return changes, nil
+}
+
+// diffRules returns the subscribers of patterns in rules that are not subscribers of the same pattern in others.
+func diffRules(file string, rules, others []rule, added bool) []subscriptionChange {
+	other := map[string]bool{}
+	for _, r := range others {
+		for _, sub := range r.subscribers {
+			other[r.pattern+" "+sub] = true
+		}
+	}
+
+	changes := []subscriptionChange{}
+	seen := map[string]bool{}
+	for _, r := range rules {
+		for _, sub := range r.subscribers {
+			key := r.pattern + " " + sub
+			if other[key] || seen[key] {
+				continue
+			}
+			seen[key] = true
+			changes = append(changes, subscriptionChange{file: file, pattern: r.pattern, subscriber: sub, added: added})
+		}
+	}
+	return changes
+}
+
+// notifyRemovedSubscribers adds the subscribers that changes remove to notifs, with the notify file that
+// removed them as their file. Removed reviewers are only mentioned, because there is nothing left to review.
+func notifyRemovedSubscribers(notifs map[string][]string, changes []subscriptionChange) {
+	subs := map[string]string{}
+	for sub := range notifs {
+		handle, _ := splitSubscriber(sub)
+		subs[handle] = sub
+	}
+
+	for _, c := range changes {
+		if c.added || c.err != nil {
+			continue
+		}
+		handle, mode := splitSubscriber(c.subscriber)
+		sub, ok := subs[handle]
+		if !ok {
+			sub = handle
+			if mode == modeSilent {
+				sub = c.subscriber
+			}
+			subs[handle] = sub
+		}
+		if !containsString(notifs[sub], c.file) {
+			notifs[sub] = append(notifs[sub], c.file)
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptionChangeLines returns a line for each pattern of a notify file with subscription changes,
+// which is formatted by format with the subscribers that are formatted by subscriber, and a line for each
+// invalid notify file, which is formatted by invalid.
+func (o *options) subscriptionChangeLines(format func(file, pattern string, added, removed []string) string, subscriber func(c subscriptionChange) string, invalid func(file string, err error) string) []string {
+	type key struct{ file, pattern string }
+	var keys []key
+	added, removed := map[key][]string{}, map[key][]string{}
+	errs := map[key]error{}
+	for _, c := range o.changedSubscriptions {
+		k := key{c.file, c.pattern}
+		if c.err != nil {
+			keys = append(keys, k)
+			errs[k] = c.err
+			continue
+		}
+		if _, ok := added[k]; !ok {
+			keys = append(keys, k)
+			added[k], removed[k] = []string{}, []string{}
+		}
+		if c.added {
+			added[k] = append(added[k], subscriber(c))
+		} else {
+			removed[k] = append(removed[k], subscriber(c))
+		}
+	}
+
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if err, ok := errs[k]; ok {
+			lines = append(lines, invalid(k.file, err))
+			continue
+		}
+		lines = append(lines, format(k.file, k.pattern, added[k], removed[k]))
+	}
+	return lines
+}
+
+// changeSummary formats the added and removed subscribers of a pattern (e.g. "added @a, removed @b").
+func changeSummary(added, removed []string) string {
+	parts := []string{}
+	if len(added) > 0 {
+		parts = append(parts, "added "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(removed, ", "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// textSubscriptionChanges returns the subscription changes for text output, or an empty string if there are none.
+func (o *options) textSubscriptionChanges() string {
+	if len(o.changedSubscriptions) == 0 {
+		return ""
+	}
+	lines := o.subscriptionChangeLines(func(file, pattern string, added, removed []string) string {
+		return fmt.Sprintf("%s %s: %s", file, pattern, changeSummary(added, removed))
+	}, func(c subscriptionChange) string {
+		return textSubscriber(c.subscriber)
+	}, func(file string, err error) string {
+		return fmt.Sprintf("%s: unable to read subscriptions: %s", file, err)
+	})
+	return fmt.Sprintf("\nSubscription changes in %s files:\n%s\n", o.filename, strings.Join(lines, "\n"))
+}
+
+// markdownSubscriptionChanges returns the subscription changes for markdown output, or an empty string if there
+// are none. Removed subscribers are only mentioned if they are notified about the change.
+func (o *options) markdownSubscriptionChanges() string {
+	if len(o.changedSubscriptions) == 0 {
+		return ""
+	}
+	lines := o.subscriptionChangeLines(func(file, pattern string, added, removed []string) string {
+		return fmt.Sprintf("* `%s` `%s`: %s", file, pattern, changeSummary(added, removed))
+	}, func(c subscriptionChange) string {
+		handle, mode := splitSubscriber(c.subscriber)
+		if !c.added && o.subscriptionChanges == subscriptionChangesNotify && mode != modeSilent {
+			return o.markdownSubscriber(handle)
+		}
+		if mode != modeMention {
+			return fmt.Sprintf("`%s` (%s)", handle, mode)
+		}
+		return "`" + handle + "`"
+	}, func(file string, err error) string {
+		return fmt.Sprintf("* `%s`: unable to read subscriptions: %s", file, err)
+	})
+	return fmt.Sprintf("\nSubscription changes in %s files:\n\n%s\n", o.filename, strings.Join(lines, "\n"))
+}
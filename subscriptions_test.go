@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSubscriptionChanges(t *testing.T) {
+	base := memfs{
+		"CODENOTIFY":     "**/*.go @go\n*.md @docs:silent @alice\n",
+		"web/CODENOTIFY": "**/*.ts @alice @web\n",
+	}
+	head := memfs{
+		"CODENOTIFY":     "**/*.go @go\n*.md @docs:silent @alice\n",
+		"web/CODENOTIFY": "**/*.ts @web @bob\n",
+		"api/CODENOTIFY": "** @api:review\n",
+	}
+	paths := []string{"README.md", "web/CODENOTIFY", "api/CODENOTIFY", "docs/CODENOTIFY"}
+
+	changes, err := subscriptionChanges(base, head, paths, "CODENOTIFY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []subscriptionChange{
+		{file: "web/CODENOTIFY", pattern: "**/*.ts", subscriber: "@alice", added: false},
+		{file: "web/CODENOTIFY", pattern: "**/*.ts", subscriber: "@bob", added: true},
+		{file: "api/CODENOTIFY", pattern: "**", subscriber: "@api:review", added: true},
+	}
+	if !reflect.DeepEqual(expected, changes) {
+		t.Errorf("expected changes %+v; got %+v", expected, changes)
+	}
+}
+
+func TestSubscriptionChangesInvalidHead(t *testing.T) {
+	os.Unsetenv("GITHUB_ACTIONS")
+	os.Unsetenv("GITLAB_CI")
+	os.Unsetenv("GITEA_ACTIONS")
+	os.Unsetenv("FORGEJO_ACTIONS")
+	os.Unsetenv("BITBUCKET_PR_ID")
+
+	gitroot := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		args = append([]string{"-C", gitroot, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("unable to run git %v: %s\n%s", args, err, string(out))
+		}
+	}
+	write := func(file, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(gitroot, file), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("CODENOTIFY", "*.go @go\n")
+	write("main.go", "package main\n")
+	git("init")
+	git("add", ".")
+	git("commit", "-m", "init")
+	write("CODENOTIFY", "*.go @go @alice:typo\n")
+	write("main.go", "package main\n\nfunc main() {}\n")
+	git("commit", "-a", "-m", "typo")
+
+	tests := []struct {
+		name   string
+		args   []string
+		stdout []string
+	}{
+		{
+			name: "off",
+			stdout: []string{
+				"HEAD~1...HEAD",
+				"@go -> main.go",
+			},
+		},
+		{
+			name: "report",
+			args: []string{"-subscription-changes", "report"},
+			stdout: []string{
+				"HEAD~1...HEAD",
+				"@go -> main.go",
+				"",
+				"Subscription changes in CODENOTIFY files:",
+				`CODENOTIFY: unable to read subscriptions: invalid subscriber in CODENOTIFY: *.go @go @alice:typo: unknown notification mode "typo" for subscriber @alice`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			args := append([]string{"-cwd", gitroot, "-baseRef", "HEAD~1", "-headRef", "HEAD"}, test.args...)
+			if err := testableMain(stdout, args); err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if expected := joinLines(test.stdout); stdout.String() != expected {
+				t.Errorf("want stdout:\n%s\ngot:\n%s", expected, stdout.String())
+			}
+		})
+	}
+}
+
+func TestNotifyRemovedSubscribers(t *testing.T) {
+	notifs := map[string][]string{
+		"@web":          {"web/index.ts"},
+		"@alice:review": {"README.md"},
+	}
+	notifyRemovedSubscribers(notifs, []subscriptionChange{
+		{file: "web/CODENOTIFY", pattern: "**/*.ts", subscriber: "@alice", added: false},
+		{file: "web/CODENOTIFY", pattern: "*.css", subscriber: "@alice", added: false},
+		{file: "web/CODENOTIFY", pattern: "**/*.ts", subscriber: "@lead:silent", added: false},
+		{file: "web/CODENOTIFY", pattern: "**/*.ts", subscriber: "@ops:review", added: false},
+		{file: "web/CODENOTIFY", pattern: "**/*.ts", subscriber: "@bob", added: true},
+		{file: "api/CODENOTIFY", err: errors.New("invalid subscriber")},
+	})
+
+	expected := map[string][]string{
+		"@web":          {"web/index.ts"},
+		"@alice:review": {"README.md", "web/CODENOTIFY"},
+		"@lead:silent":  {"web/CODENOTIFY"},
+		"@ops":          {"web/CODENOTIFY"},
+	}
+	if !reflect.DeepEqual(expected, notifs) {
+		t.Errorf("expected notifications %v; got %v", expected, notifs)
+	}
+}
+
+func TestWriteSubscriptionChanges(t *testing.T) {
+	changes := []subscriptionChange{
+		{file: "web/CODENOTIFY", pattern: "**/*.ts", subscriber: "@alice", added: false},
+		{file: "web/CODENOTIFY", pattern: "**/*.ts", subscriber: "@bob", added: true},
+		{file: "web/CODENOTIFY", pattern: "*.css", subscriber: "@lead:silent", added: false},
+		{file: "api/CODENOTIFY", err: errors.New("invalid subscriber")},
+	}
+	notifs := map[string][]string{"@alice": {"web/CODENOTIFY"}}
+
+	tests := []struct {
+		name     string
+		opts     options
+		expected string
+	}{
+		{
+			name: "text",
+			opts: options{format: "text", subscriptionChanges: subscriptionChangesReport},
+			expected: joinLines([]string{
+				"a...b",
+				"@alice -> web/CODENOTIFY",
+				"",
+				"Subscription changes in CODENOTIFY files:",
+				"web/CODENOTIFY **/*.ts: added @bob, removed @alice",
+				"web/CODENOTIFY *.css: removed @lead (silent)",
+				"api/CODENOTIFY: unable to read subscriptions: invalid subscriber",
+			}),
+		},
+		{
+			name: "markdown report",
+			opts: options{format: "markdown", subscriptionChanges: subscriptionChangesReport},
+			expected: joinLines([]string{
+				"<!-- codenotify:CODENOTIFY report -->",
+				"[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff a...b.",
+				"",
+				"| Notify | File(s) |",
+				"|-|-|",
+				"| @alice | web/CODENOTIFY |",
+				"",
+				"Subscription changes in CODENOTIFY files:",
+				"",
+				"* `web/CODENOTIFY` `**/*.ts`: added `@bob`, removed `@alice`",
+				"* `web/CODENOTIFY` `*.css`: removed `@lead` (silent)",
+				"* `api/CODENOTIFY`: unable to read subscriptions: invalid subscriber",
+			}),
+		},
+		{
+			name: "markdown notify",
+			opts: options{format: "markdown", subscriptionChanges: subscriptionChangesNotify},
+			expected: joinLines([]string{
+				"<!-- codenotify:CODENOTIFY report -->",
+				"[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff a...b.",
+				"",
+				"| Notify | File(s) |",
+				"|-|-|",
+				"| @alice | web/CODENOTIFY |",
+				"",
+				"Subscription changes in CODENOTIFY files:",
+				"",
+				"* `web/CODENOTIFY` `**/*.ts`: added `@bob`, removed @alice",
+				"* `web/CODENOTIFY` `*.css`: removed `@lead` (silent)",
+				"* `api/CODENOTIFY`: unable to read subscriptions: invalid subscriber",
+			}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := test.opts
+			o.filename, o.baseRef, o.headRef = "CODENOTIFY", "a", "b"
+			o.changedSubscriptions = changes
+			buf := bytes.Buffer{}
+			if err := o.writeNotifications(&buf, notifs); err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if buf.String() != test.expected {
+				t.Errorf("\nwant: %q\n got: %q", test.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestParseSubscriptionChanges(t *testing.T) {
+	for value, expected := range map[string]string{"": "off", "report": "report", "notify": "notify"} {
+		actual, err := parseSubscriptionChanges("-subscription-changes", value)
+		if err != nil || actual != expected {
+			t.Errorf("expected %q for %q; got %q, %v", expected, value, actual, err)
+		}
+	}
+	if _, err := parseSubscriptionChanges("-subscription-changes", "all"); err == nil {
+		t.Error("expected error for invalid value")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// templateData is the data that output templates are executed with.
+type templateData struct {
+	// Filename is the filename in which file subscribers are defined (e.g. CODENOTIFY).
+	Filename string
+	// BaseRef and HeadRef are the refs of the diff, if they are known.
+	BaseRef string
+	HeadRef string
+	// Source is the file (or stdin) that the changes were read from with -paths or -patch, if any.
+	Source string
+	// URL is the web URL of the pull request, if known.
+	URL string
+	// Author is the handle of the author of the pull request, if known.
+	Author string
+	// SubscriberThreshold is the configured threshold, or 0 if disabled.
+	SubscriberThreshold int
+	// ThresholdExceeded is true if there are more subscribers than the threshold.
+	// Subscribers is empty in that case, so that templates don't notify them by accident.
+	ThresholdExceeded bool
+	// SubscriberCount is the number of subscribers, even if the threshold is exceeded.
+	SubscriberCount int
+	// Subscribers are sorted by handle.
+	Subscribers []templateSubscriber
+}
+
+// templateSubscriber is a subscriber in templateData.
+type templateSubscriber struct {
+	Handle string
+	// Mode is mention, silent or review.
+	Mode string
+	// Mention is the subscriber as the built-in format would write it
+	// (e.g. @alice, or `@alice` for a silent subscriber in markdown).
+	Mention string
+	// FromPullRequest is true if the subscriber is only notified because of the notify files
+	// of the pull request itself, which requires union rules.
+	FromPullRequest bool
+	// Files are the changed files that the subscriber is subscribed to.
+	Files []templateFile
+}
+
+// templateFile is a changed file in templateData.
+type templateFile struct {
+	Path string
+	// Change is added, modified, deleted, renamed or copied, if the changes were read from a patch.
+	Change string
+	// From is the path that the file was renamed or copied from, and To is the path that it was renamed to.
+	From string
+	To   string
+	// Rules are the rules that subscribe the subscriber to the file.
+	Rules []templateRule
+	// FromPullRequest is true if the subscriber is only subscribed to the file because of the
+	// notify files of the pull request itself.
+	FromPullRequest bool
+}
+
+// templateRule is a rule in a notify file.
+type templateRule struct {
+	// File is the path of the notify file and Line is the line number of the rule in it.
+	File    string
+	Line    int
+	Pattern string
+}
+
+// templateFuncs are the functions that templates can use in addition to the built-in ones.
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// parseTemplate reads and parses the output template in filename.
+func parseTemplate(filename string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read template: %w", err)
+	}
+
+	t, err := template.New(filename).Funcs(templateFuncs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return t, nil
+}
+
+// loadTemplate sets the output template of o to the one in filename, unless it is empty.
+func (o *options) loadTemplate(filename string) error {
+	if filename == "" {
+		return nil
+	}
+	t, err := parseTemplate(filename)
+	if err != nil {
+		return err
+	}
+	o.template = t
+	return nil
+}
+
+// provenance returns the rules that subscribe each subscriber handle to each of the paths.
+func provenance(fs FS, paths []string, notifyFilename string) (map[string]map[string][]rule, error) {
+	rules := map[string]map[string][]rule{}
+	for _, path := range paths {
+		matches, err := matchingRules(fs, path, notifyFilename)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range matches {
+			for _, sub := range r.subscribers {
+				handle, _ := splitSubscriber(sub)
+				if rules[handle] == nil {
+					rules[handle] = map[string][]rule{}
+				}
+				rules[handle][path] = append(rules[handle][path], r)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// templateData returns the data that the output template is executed with.
+func (o *options) templateData(notifs map[string][]string) templateData {
+	data := templateData{
+		Filename:            o.filename,
+		BaseRef:             o.baseRef,
+		HeadRef:             o.headRef,
+		Source:              o.source,
+		URL:                 o.url,
+		Author:              o.author,
+		SubscriberThreshold: o.subscriberThreshold,
+		ThresholdExceeded:   o.exceedsThreshold(notifs),
+		SubscriberCount:     len(notifs),
+		Subscribers:         []templateSubscriber{},
+	}
+	if data.ThresholdExceeded {
+		return data
+	}
+
+	subs := make([]string, 0, len(notifs))
+	for sub := range notifs {
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+
+	for _, sub := range subs {
+		handle, mode := splitSubscriber(sub)
+		s := templateSubscriber{Handle: handle, Mode: string(mode), Mention: textSubscriber(sub), FromPullRequest: o.addedByPullRequest[handle]}
+		if mode == modeMention {
+			s.Mode = "mention"
+		}
+		if o.format == "markdown" {
+			s.Mention = o.markdownSubscriber(sub)
+		}
+
+		for _, path := range notifs[sub] {
+			f := templateFile{Path: path, Rules: []templateRule{}, FromPullRequest: o.filesAddedByPullRequest[handle][path]}
+			if c, ok := o.fileChanges[path]; ok {
+				f.Change = c.change
+				if c.path == path {
+					f.From = c.from
+				} else {
+					f.To = c.path
+				}
+			}
+			for _, r := range o.provenance[handle][path] {
+				f.Rules = append(f.Rules, templateRule{File: r.file, Line: r.line, Pattern: r.pattern})
+			}
+			s.Files = append(s.Files, f)
+		}
+		data.Subscribers = append(data.Subscribers, s)
+	}
+	return data
+}
+
+// writeTemplate writes the notifications with the output template.
+func (o *options) writeTemplate(w io.Writer, notifs map[string][]string) error {
+	if err := o.template.Execute(w, o.templateData(notifs)); err != nil {
+		return fmt.Errorf("error executing template: %w", err)
+	}
+	return nil
+}
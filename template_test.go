@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteTemplate(t *testing.T) {
+	fs := memfs{
+		"CODENOTIFY":     "**/*.go @go\n\n# reviewers\n*.go @lead:review\n",
+		"web/CODENOTIFY": "** @web:silent\n",
+	}
+	paths := []string{"main.go", "dir/file.go", "web/index.js"}
+	notifs, err := notifications(fs, paths, "CODENOTIFY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prov, err := provenance(fs, paths, "CODENOTIFY")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := filepath.Join(t.TempDir(), "template")
+	writeFile(t, tmpl, `{{.BaseRef}}...{{.HeadRef}} by {{.Author}} ({{.SubscriberCount}})
+{{range .Subscribers}}{{.Mention}} [{{.Mode}}]
+{{range .Files}}  {{.Path}}{{range .Rules}} <- {{.File}}:{{.Line}} {{.Pattern}}{{end}}
+{{end}}{{end}}`)
+
+	tests := []struct {
+		name   string
+		format string
+		output string
+	}{
+		{
+			name:   "text",
+			format: "text",
+			output: `a...b by @author (3)
+@go [mention]
+  main.go <- CODENOTIFY:1 **/*.go
+  dir/file.go <- CODENOTIFY:1 **/*.go
+@lead (review) [review]
+  main.go <- CODENOTIFY:4 *.go
+@web (silent) [silent]
+  web/index.js <- web/CODENOTIFY:1 **
+`,
+		},
+		{
+			name:   "markdown",
+			format: "markdown",
+			output: `<!-- codenotify:CODENOTIFY report -->
+a...b by @author (3)
+@go [mention]
+  main.go <- CODENOTIFY:1 **/*.go
+  dir/file.go <- CODENOTIFY:1 **/*.go
+@lead (review) [review]
+  main.go <- CODENOTIFY:4 *.go
+` + "`@web` [silent]" + `
+  web/index.js <- web/CODENOTIFY:1 **
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := options{
+				filename:   "CODENOTIFY",
+				format:     test.format,
+				baseRef:    "a",
+				headRef:    "b",
+				author:     "@author",
+				provenance: prov,
+			}
+			if err := o.loadTemplate(tmpl); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := bytes.Buffer{}
+			if err := o.writeNotifications(&buf, notifs); err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+			if buf.String() != test.output {
+				t.Errorf("expected:\n%s\ngot:\n%s", test.output, buf.String())
+			}
+		})
+	}
+}
+
+func TestWriteTemplateThreshold(t *testing.T) {
+	tmpl := filepath.Join(t.TempDir(), "template")
+	writeFile(t, tmpl, `{{if .ThresholdExceeded}}{{.SubscriberCount}} > {{.SubscriberThreshold}}{{end}}{{range .Subscribers}}{{.Handle}}{{end}}`)
+
+	o := options{format: "text", subscriberThreshold: 1}
+	if err := o.loadTemplate(tmpl); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.Buffer{}
+	if err := o.writeNotifications(&buf, map[string][]string{"@a": {"a"}, "@b": {"b"}}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if buf.String() != "2 > 1" {
+		t.Errorf("expected subscribers to be omitted; got %q", buf.String())
+	}
+}
+
+func TestLoadTemplateError(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid")
+	writeFile(t, invalid, "{{range .Subscribers}")
+
+	tests := []struct {
+		filename string
+		err      string
+	}{
+		{filename: filepath.Join(dir, "missing"), err: "unable to read template"},
+		{filename: invalid, err: "invalid template"},
+	}
+	for _, test := range tests {
+		o := options{}
+		err := o.loadTemplate(test.filename)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expected %q error for %s; got %v", test.err, test.filename, err)
+		}
+	}
+
+	o := options{}
+	if err := o.loadTemplate(""); err != nil || o.template != nil {
+		t.Errorf("expected no template; got %v, %v", o.template, err)
+	}
+}
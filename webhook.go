@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// webhookSignatureHeader is the header with the HMAC-SHA256 signature of the payload,
+// in the same format as GitHub's X-Hub-Signature-256 header (e.g. sha256=hex).
+const webhookSignatureHeader = "X-Codenotify-Signature-256"
+
+// webhookAttempts is the maximum number of times that a payload is sent.
+const webhookAttempts = 5
+
+// webhookConfig configures the outgoing webhook of a run.
+type webhookConfig struct {
+	// url is the URL that payloads are posted to.
+	url string
+	// secret is the key that payloads are signed with, if set.
+	secret string
+}
+
+// enabled returns true if the webhook is configured.
+func (c *webhookConfig) enabled() bool {
+	return c.url != ""
+}
+
+// addWebhookFromEnv adds the outgoing webhook to o if it is configured by the env vars of n.
+func addWebhookFromEnv(o *options, n envNaming) {
+	config := webhookConfig{
+		url:    n.get("webhook"),
+		secret: n.get("webhook-secret"),
+	}
+	if config.enabled() {
+		o.addPrint(notifyWebhook(o, config))
+	}
+}
+
+// webhookPayload is the JSON payload that is posted to the webhook.
+type webhookPayload struct {
+	// Filename is the filename in which file subscribers are defined (e.g. CODENOTIFY).
+	Filename string `json:"filename"`
+	BaseRef  string `json:"base_ref"`
+	HeadRef  string `json:"head_ref"`
+	// Source is the file (or stdin) that the changes were read from with -paths or -patch, if any.
+	Source string `json:"source,omitempty"`
+	// PullRequest is set if the diff belongs to a pull request.
+	PullRequest *webhookPullRequest `json:"pull_request,omitempty"`
+	// SubscriberThreshold is the configured threshold, or 0 if disabled.
+	SubscriberThreshold int `json:"subscriber_threshold"`
+	// ThresholdExceeded is true if there are more subscribers than the threshold,
+	// in which case codenotify doesn't notify them.
+	ThresholdExceeded bool                `json:"threshold_exceeded"`
+	Subscribers       []webhookSubscriber `json:"subscribers"`
+}
+
+type webhookPullRequest struct {
+	URL    string `json:"url,omitempty"`
+	Author string `json:"author,omitempty"`
+}
+
+type webhookSubscriber struct {
+	Handle string `json:"handle"`
+	// Mode is mention, silent or review.
+	Mode  string   `json:"mode"`
+	Files []string `json:"files"`
+}
+
+// newWebhookPayload returns the payload for the notifications.
+func newWebhookPayload(o *options, notifs map[string][]string) webhookPayload {
+	p := webhookPayload{
+		Filename:            o.filename,
+		BaseRef:             o.baseRef,
+		HeadRef:             o.headRef,
+		Source:              o.source,
+		SubscriberThreshold: o.subscriberThreshold,
+		ThresholdExceeded:   o.exceedsThreshold(notifs),
+		Subscribers:         []webhookSubscriber{},
+	}
+	if o.url != "" || o.author != "" {
+		p.PullRequest = &webhookPullRequest{URL: o.url, Author: o.author}
+	}
+
+	subs := make([]string, 0, len(notifs))
+	for sub := range notifs {
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+
+	for _, sub := range subs {
+		handle, mode := splitSubscriber(sub)
+		if mode == modeMention {
+			mode = "mention"
+		}
+		p.Subscribers = append(p.Subscribers, webhookSubscriber{Handle: handle, Mode: string(mode), Files: notifs[sub]})
+	}
+	return p
+}
+
+// notifyWebhook returns a print function that posts the notifications to the webhook.
+// Payloads are posted even if there are no notifications, so that receivers can clear previous ones.
+func notifyWebhook(o *options, config webhookConfig) func(map[string][]string) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	return func(notifs map[string][]string) error {
+		body, err := json.Marshal(newWebhookPayload(o, notifs))
+		if err != nil {
+			return err
+		}
+
+		for attempt := 0; ; attempt++ {
+			err = postWebhook(client, config, body)
+			if err == nil {
+				return nil
+			}
+
+			wait, retry := retryDelay(err, attempt)
+			if !retry || attempt+1 == webhookAttempts {
+				// Webhook URLs often contain credentials.
+				return redactError(fmt.Errorf("error posting to webhook: %w", err), config.url)
+			}
+			fmt.Fprintf(verbose, "retrying webhook in %s: %s\n", wait, err)
+			sleep(wait)
+		}
+	}
+}
+
+// webhookSignature returns the value of the signature header for the body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(client *http.Client, config webhookConfig, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, config.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "codenotify")
+	if config.secret != "" {
+		req.Header.Set(webhookSignatureHeader, webhookSignature(config.secret, body))
+	}
+
+	fmt.Fprintf(verbose, "posting to webhook %s\n", req.URL.Host)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	respdump, err := dumpResponse(resp)
+	if err != nil {
+		return fmt.Errorf("error dumping response: %w", err)
+	}
+	return &statusError{statusCode: resp.StatusCode, details: string(respdump)}
+}
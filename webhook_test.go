@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifyWebhook(t *testing.T) {
+	var payloads []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifyWebhookSignature(t, "webhook-secret", r.Header.Get("X-Codenotify-Signature-256"), body)
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected application/json content type; got %s", ct)
+		}
+
+		payload := map[string]interface{}{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("unable to decode payload: %s", err)
+		}
+		payloads = append(payloads, payload)
+	}))
+	defer server.Close()
+
+	o := &options{
+		filename:            "CODENOTIFY",
+		baseRef:             "a",
+		headRef:             "b",
+		author:              "@author",
+		url:                 "https://github.com/o/r/pull/1",
+		subscriberThreshold: 5,
+	}
+	print := notifyWebhook(o, webhookConfig{url: server.URL, secret: "webhook-secret"})
+	if err := print(map[string][]string{
+		"@go":          {"file.go", "dir/file.go"},
+		"@lead:silent": {"file.go"},
+		"@dba:review":  {"db.sql"},
+	}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if err := print(map[string][]string{}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+
+	// The payload schema is decoded generically so that renaming a field breaks the test.
+	expected := []map[string]interface{}{
+		{
+			"filename": "CODENOTIFY",
+			"base_ref": "a",
+			"head_ref": "b",
+			"pull_request": map[string]interface{}{
+				"url":    "https://github.com/o/r/pull/1",
+				"author": "@author",
+			},
+			"subscriber_threshold": float64(5),
+			"threshold_exceeded":   false,
+			"subscribers": []interface{}{
+				map[string]interface{}{"handle": "@dba", "mode": "review", "files": []interface{}{"db.sql"}},
+				map[string]interface{}{"handle": "@go", "mode": "mention", "files": []interface{}{"file.go", "dir/file.go"}},
+				map[string]interface{}{"handle": "@lead", "mode": "silent", "files": []interface{}{"file.go"}},
+			},
+		},
+		{
+			"filename": "CODENOTIFY",
+			"base_ref": "a",
+			"head_ref": "b",
+			"pull_request": map[string]interface{}{
+				"url":    "https://github.com/o/r/pull/1",
+				"author": "@author",
+			},
+			"subscriber_threshold": float64(5),
+			"threshold_exceeded":   false,
+			"subscribers":          []interface{}{},
+		},
+	}
+	if !reflect.DeepEqual(expected, payloads) {
+		t.Errorf("expected payloads:\n%v\ngot:\n%v", expected, payloads)
+	}
+}
+
+func TestNotifyWebhookUnsigned(t *testing.T) {
+	var payload webhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sig := r.Header.Get("X-Codenotify-Signature-256"); sig != "" {
+			t.Errorf("expected no signature without a secret; got %s", sig)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("unable to decode payload: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	o := &options{baseRef: "a", headRef: "b", subscriberThreshold: 1}
+	if err := notifyWebhook(o, webhookConfig{url: server.URL})(map[string][]string{"@a": {"a"}, "@b": {"b"}}); err != nil {
+		t.Fatalf("expected nil error; got %s", err)
+	}
+	if !payload.ThresholdExceeded || payload.PullRequest != nil {
+		t.Errorf("expected exceeded threshold and no pull request; got %+v", payload)
+	}
+}
+
+func TestNotifyWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		err      bool
+	}{
+		{
+			name:     "success after server errors",
+			statuses: []int{http.StatusBadGateway, http.StatusTooManyRequests, http.StatusOK},
+			requests: 3,
+		},
+		{
+			name:     "client error is not retried",
+			statuses: []int{http.StatusBadRequest},
+			requests: 1,
+			err:      true,
+		},
+		{
+			name:     "gives up after max attempts",
+			statuses: []int{500, 500, 500, 500, 500, 500},
+			requests: 5,
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var waited time.Duration
+			fakeTime(t, time.Now(), &waited)
+
+			var bodies []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				bodies = append(bodies, string(body))
+				w.WriteHeader(test.statuses[len(bodies)-1])
+			}))
+			defer server.Close()
+
+			url := server.URL + "/hooks/secret-token"
+			err := notifyWebhook(&options{}, webhookConfig{url: url, secret: "s"})(map[string][]string{"@a": {"a"}})
+			if test.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if strings.Contains(err.Error(), "secret-token") {
+					t.Errorf("expected webhook URL to be redacted from error:\n%s", err)
+				}
+			} else if err != nil {
+				t.Fatalf("expected nil error; got %s", err)
+			}
+
+			if len(bodies) != test.requests {
+				t.Fatalf("expected %d requests; got %d", test.requests, len(bodies))
+			}
+			for _, body := range bodies {
+				if body != bodies[0] {
+					t.Errorf("expected retries to send the same payload; got %s and %s", bodies[0], body)
+				}
+			}
+			if test.requests > 1 && waited == 0 {
+				t.Errorf("expected to wait between retries")
+			}
+		})
+	}
+}
+
+func TestNotifyWebhookNetworkError(t *testing.T) {
+	var waited time.Duration
+	fakeTime(t, time.Now(), &waited)
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL + "/hooks/secret-token"
+	server.Close()
+
+	err := notifyWebhook(&options{}, webhookConfig{url: url})(map[string][]string{})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("expected webhook URL to be redacted from error:\n%s", err)
+	}
+	if waited == 0 {
+		t.Errorf("expected network errors to be retried")
+	}
+}
+
+// verifyWebhookSignature verifies the signature the way that a receiver would.
+func verifyWebhookSignature(t *testing.T, secret, signature string, body []byte) {
+	t.Helper()
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		t.Errorf("invalid signature %q; expected %q", signature, expected)
+	}
+}